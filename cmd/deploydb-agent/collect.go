@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/exporter"
+	"github.com/deploydb/agent/internal/postgres"
+)
+
+// collectResult is the outcome of one collector run.
+type collectResult struct {
+	collector.Status
+	Values map[string]float64 `json:"values"`
+}
+
+// collectCmd implements the 'collect' subcommand - runs the collectors
+// locally and prints what the agent would send.
+func collectCmd() {
+	collectFlags := flag.NewFlagSet("collect", flag.ExitOnError)
+	configPath := collectFlags.String("config", "/etc/deploydb/config.yaml", "Path to configuration file")
+	watch := collectFlags.Bool("watch", false, "Keep collecting every interval until interrupted")
+	interval := collectFlags.Duration("interval", 0, "Time between collections, implies --watch (default: metrics_interval)")
+	filter := collectFlags.String("collector", "", "Comma-separated collectors to run (default: all): "+strings.Join(collector.Collectors, ", "))
+	format := collectFlags.String("format", "table", "Output format: table, json or prometheus")
+
+	if err := collectFlags.Parse(os.Args[2:]); err != nil {
+		os.Exit(1)
+	}
+	if *interval < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --interval must be positive")
+		os.Exit(1)
+	}
+	if *interval > 0 {
+		*watch = true
+	}
+
+	names, err := collectorNames(*filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	write, ok := collectWriters[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (table, json or prometheus)\n", *format)
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *interval == 0 {
+		*interval = cfg.MetricsInterval
+	}
+
+	// Keep stdout parseable; only problems go to stderr
+	slog.SetDefault(setupLogger("warn"))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	metricsCollector, dbs := openCollector(ctx, cfg)
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+
+	for {
+		results, failed := collectOnce(ctx, metricsCollector, names)
+		write(os.Stdout, results)
+
+		if !*watch {
+			if failed {
+				os.Exit(1)
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*interval):
+			fmt.Println()
+		}
+	}
+}
+
+// collectorNames parses the --collector filter.
+func collectorNames(filter string) ([]string, error) {
+	if filter == "" {
+		return collector.Collectors, nil
+	}
+	var names []string
+	for _, name := range strings.Split(filter, ",") {
+		name = strings.TrimSpace(name)
+		if !collector.IsCollector(name) {
+			return nil, fmt.Errorf("unknown collector %q (available: %s)", name, strings.Join(collector.Collectors, ", "))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// openCollector connects to every configured instance and returns a
+// collector for them. Instances that cannot be reached are reported and
+// left without a connection, like in the agent.
+func openCollector(ctx context.Context, cfg *config.Config) (*collector.Collector, []*sql.DB) {
+	var instances []collector.Instance
+	var dbs []*sql.DB
+	for _, instance := range cfg.Instances() {
+		db, err := postgres.Open(ctx, instance.PostgresConfig)
+		if err != nil {
+			name := "PostgreSQL"
+			if instance.ID != "" {
+				name += " instance " + instance.ID
+			}
+			fmt.Fprintf(os.Stderr, "Warning: %s not available, its metrics are skipped: %v\n", name, err)
+		} else {
+			dbs = append(dbs, db)
+		}
+		instances = append(instances, collector.Instance{ID: instance.ID, DB: db, DataDir: instance.DataDir})
+	}
+	return collector.New(collector.Config{Instances: instances}), dbs
+}
+
+// collectOnce runs the named collectors and reports whether any failed.
+func collectOnce(ctx context.Context, c *collector.Collector, names []string) ([]collectResult, bool) {
+	results := make([]collectResult, 0, len(names))
+	failed := false
+	for _, name := range names {
+		values, err := c.Run(ctx, name)
+		if err != nil {
+			failed = true
+		}
+		for _, status := range c.Status() {
+			if status.Name == name {
+				results = append(results, collectResult{Status: status, Values: values})
+			}
+		}
+	}
+	return results, failed
+}
+
+// collectWriters print collection results in each --format.
+var collectWriters = map[string]func(io.Writer, []collectResult){
+	"table":      writeCollectTable,
+	"json":       writeCollectJSON,
+	"prometheus": writeCollectPrometheus,
+}
+
+// writeCollectTable prints a summary of each collector followed by every
+// metric.
+func writeCollectTable(w io.Writer, results []collectResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTOR\tDURATION\tMETRICS\tERROR")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n",
+			result.Name, result.Duration.Round(time.Microsecond), len(result.Values), strings.ReplaceAll(result.Error, "\n", "; "))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tVALUE\tCOLLECTOR")
+	for _, result := range results {
+		for _, name := range sortedKeys(result.Values) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, strconv.FormatFloat(result.Values[name], 'g', -1, 64), result.Name)
+		}
+	}
+	tw.Flush()
+}
+
+// writeCollectJSON prints the results as a JSON document.
+func writeCollectJSON(w io.Writer, results []collectResult) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]any{
+		"timestamp":  time.Now().UTC(),
+		"collectors": results,
+	})
+}
+
+// writeCollectPrometheus prints the metrics as the exporter serves them,
+// with each collector's timing and error as comments.
+func writeCollectPrometheus(w io.Writer, results []collectResult) {
+	metrics := make(map[string]float64)
+	for _, result := range results {
+		fmt.Fprintf(w, "# collector %s: %s, %d metrics", result.Name, result.Duration.Round(time.Microsecond), len(result.Values))
+		if result.Error != "" {
+			fmt.Fprintf(w, ", error: %s", strings.ReplaceAll(result.Error, "\n", "; "))
+		}
+		fmt.Fprintln(w)
+		for name, value := range result.Values {
+			metrics[name] = value
+		}
+	}
+	exporter.WritePrometheus(w, metrics)
+}
+
+// sortedKeys returns the metric names in alphabetical order.
+func sortedKeys(metrics map[string]float64) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
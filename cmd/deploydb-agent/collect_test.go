@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+)
+
+func TestCollectorNames(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    []string
+		wantErr bool
+	}{
+		{"", collector.Collectors, false},
+		{"disk", []string{"disk"}, false},
+		{"postgres, system", []string{"postgres", "system"}, false},
+		{"postgres,bogus", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := collectorNames(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("collectorNames(%q) error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("collectorNames(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectWriters(t *testing.T) {
+	results := []collectResult{
+		{
+			Status: collector.Status{Name: "system", Enabled: true, Duration: 1500 * time.Microsecond, Metrics: 2},
+			Values: map[string]float64{"system_load_1m": 0.5, "system_cpu_count": 4},
+		},
+		{
+			Status: collector.Status{Name: "disk", Enabled: true, Error: "statfs /data: permission denied\nstatfs /wal: permission denied"},
+			Values: map[string]float64{},
+		},
+	}
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"table", []string{
+			"COLLECTOR  DURATION  METRICS  ERROR",
+			"system     1.5ms     2",
+			"disk       0s        0        statfs /data: permission denied; statfs /wal: permission denied",
+			"system_cpu_count  4      system",
+			"system_load_1m    0.5    system",
+		}},
+		{"prometheus", []string{
+			"# collector system: 1.5ms, 2 metrics\n",
+			"# collector disk: 0s, 0 metrics, error: statfs /data: permission denied; statfs /wal: permission denied\n",
+			"# TYPE system_load_1m gauge\nsystem_load_1m 0.5\n",
+			"system_cpu_count 4\n",
+		}},
+		{"json", []string{
+			`"name": "system"`,
+			`"duration_ns": 1500000`,
+			`"system_load_1m": 0.5`,
+			`"error": "statfs /data: permission denied\nstatfs /wal: permission denied"`,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			collectWriters[tt.format](&buf, results)
+			out := buf.String()
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output missing %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteCollectJSON_Parses(t *testing.T) {
+	var buf bytes.Buffer
+	writeCollectJSON(&buf, []collectResult{{
+		Status: collector.Status{Name: "postgres", Enabled: true, Metrics: 1},
+		Values: map[string]float64{`pg_up{instance_id="main"}`: 1},
+	}})
+
+	var doc struct {
+		Timestamp  time.Time       `json:"timestamp"`
+		Collectors []collectResult `json:"collectors"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	if doc.Timestamp.IsZero() || len(doc.Collectors) != 1 || doc.Collectors[0].Values[`pg_up{instance_id="main"}`] != 1 {
+		t.Errorf("decoded = %+v", doc)
+	}
+}
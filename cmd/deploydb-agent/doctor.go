@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deploydb/agent/internal/doctor"
+)
+
+// doctorCmd implements the 'doctor' subcommand - preflight checks of the
+// config, control plane and PostgreSQL access.
+func doctorCmd() {
+	doctorFlags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := doctorFlags.String("config", "/etc/deploydb/config.yaml", "Path to configuration file")
+	timeout := doctorFlags.Duration("timeout", 10*time.Second, "Timeout for each network check")
+	asJSON := doctorFlags.Bool("json", false, "Print the report as JSON")
+
+	if err := doctorFlags.Parse(os.Args[2:]); err != nil {
+		os.Exit(1)
+	}
+
+	report := doctor.Run(context.Background(), doctor.Options{
+		ConfigPath: *configPath,
+		Timeout:    *timeout,
+	})
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		printReport(os.Stdout, report)
+	}
+
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
+
+// printReport writes one line per check, followed by its hint.
+func printReport(w io.Writer, report doctor.Report) {
+	counts := make(map[doctor.Status]int)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, result := range report.Results {
+		counts[result.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(string(result.Status)), result.Check, result.Message)
+		if result.Hint != "" {
+			fmt.Fprintf(tw, "\t\t-> %s\n", result.Hint)
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", counts[doctor.Pass], counts[doctor.Warn], counts[doctor.Fail])
+}
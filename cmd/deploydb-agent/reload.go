@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/connection"
+	"github.com/deploydb/agent/internal/postgres"
+)
+
+// reloader re-reads the config file and applies what it can to the running
+// agent. Settings wired up once at startup are logged as needing a restart.
+type reloader struct {
+	path        string
+	logger      *slog.Logger
+	current     *config.Config                  // the settings in effect
+	supervisors map[string]*postgres.Supervisor // by instance ID
+	collector   *collector.Collector
+	manager     *connection.Manager
+}
+
+// reload loads the config file and applies the changes. An invalid file is
+// logged and the running config is kept. Keys that need a restart keep
+// their running value, so they are reported again on the next reload.
+func (r *reloader) reload(ctx context.Context) {
+	next, err := config.Load(r.path)
+	if err != nil {
+		r.logger.Error("config reload failed, keeping the running config", "path", r.path, "error", err)
+		return
+	}
+
+	changed := config.Changed(r.current, next)
+	if len(changed) == 0 {
+		r.logger.Info("config reloaded, nothing changed", "path", r.path)
+		return
+	}
+
+	// version and token_file are reflected in the fields they lead to
+	applied := *r.current
+	applied.Version, applied.TokenFile = next.Version, next.TokenFile
+	controlPlaneChanged, postgresChanged := false, false
+	for _, key := range changed {
+		switch key {
+		case "log_level":
+			level, err := parseLogLevel(next.LogLevel)
+			if err != nil {
+				r.logger.Warn("ignoring log_level", "error", err)
+				continue
+			}
+			logLevel.Set(level)
+			applied.LogLevel = next.LogLevel
+		case "postgres", "postgres_instances":
+			if !postgresChanged {
+				postgresChanged = true
+				r.reloadPostgres(next, &applied)
+			}
+		case "metrics_interval":
+			r.manager.SetMetricsInterval(next.MetricsInterval)
+			applied.MetricsInterval = next.MetricsInterval
+		case "control_plane_url", "control_plane_endpoints", "token":
+			controlPlaneChanged = true
+		case "version", "token_file":
+			// Applied with the keys above
+		default:
+			r.logger.Warn("config change requires a restart", "key", key)
+		}
+	}
+
+	// Reconnect once for any number of control plane changes
+	if controlPlaneChanged {
+		r.manager.SetControlPlane(next.Endpoints(), next.Token)
+		applied.ControlPlaneURL = next.ControlPlaneURL
+		applied.ControlPlaneEndpoints = next.ControlPlaneEndpoints
+		applied.Token = next.Token
+	}
+
+	r.current = &applied
+	r.logger.Info("config reloaded", "path", r.path, "changed", changed)
+}
+
+// reloadPostgres reconnects to the instances whose connection settings
+// changed and points the collector at new data directories. Adding,
+// removing or relabeling instances needs a restart.
+func (r *reloader) reloadPostgres(next, applied *config.Config) {
+	current, updated := r.current.Instances(), next.Instances()
+	if len(current) != len(updated) {
+		r.logger.Warn("config change requires a restart", "key", "postgres_instances")
+		return
+	}
+	for i := range current {
+		if current[i].ID != updated[i].ID {
+			r.logger.Warn("config change requires a restart", "key", "postgres_instances")
+			return
+		}
+	}
+
+	instances := make([]config.PostgresInstance, len(updated))
+	for i, instance := range updated {
+		if current[i].Label != instance.Label {
+			r.logger.Warn("config change requires a restart", "key", "postgres_instances", "instance", instance.ID)
+			instance.Label = current[i].Label
+		}
+		instances[i] = instance
+
+		// data_dir is only used by the collector, not for connecting
+		if current[i].DataDir != instance.DataDir {
+			if err := r.collector.SetDataDir(instance.ID, instance.DataDir); err != nil {
+				r.logger.Warn("cannot apply data_dir", "instance", instance.ID, "error", err)
+			}
+		}
+		if current[i].DSN() != instance.DSN() || current[i].TargetSessionAttrs != instance.TargetSessionAttrs {
+			r.supervisors[instance.ID].Reconfigure(instance.PostgresConfig)
+		}
+	}
+
+	applied.Postgres = next.Postgres
+	if len(next.PostgresInstances) > 0 {
+		applied.PostgresInstances = instances
+	} else {
+		applied.PostgresInstances = nil
+	}
+}
+
+// watchConfig signals reload when the config file's size or modification
+// time changes. It polls rather than relying on inotify so it also works
+// for Kubernetes ConfigMaps, which are swapped by symlink.
+func watchConfig(ctx context.Context, path string, interval time.Duration, reload chan<- struct{}) {
+	stamp := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+
+	lastMod, lastSize := stamp()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := stamp()
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
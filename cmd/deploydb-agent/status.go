@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/connection"
+	"github.com/deploydb/agent/internal/control"
+	"github.com/deploydb/agent/internal/postgres"
+)
+
+// agentStatus is the result of the control socket's status operation.
+type agentStatus struct {
+	Version         string             `json:"version"`
+	ConfigPath      string             `json:"config_path"`
+	StartedAt       time.Time          `json:"started_at"`
+	UptimeSeconds   float64            `json:"uptime_seconds"`
+	State           string             `json:"state"`
+	Endpoint        string             `json:"endpoint,omitempty"`
+	ServerID        string             `json:"server_id,omitempty"`
+	Error           string             `json:"error,omitempty"`
+	LastMetricsSent time.Time          `json:"last_metrics_sent,omitzero"`
+	QueuedCommands  int                `json:"queued_commands"`
+	Postgres        []postgresStatus   `json:"postgres"`
+	Collectors      []collector.Status `json:"collectors"`
+}
+
+// postgresStatus is the connection state of one PostgreSQL instance.
+type postgresStatus struct {
+	ID      string `json:"id,omitempty"`
+	Up      bool   `json:"up"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// statusSource gathers the status of the running agent.
+type statusSource struct {
+	configPath  string
+	startedAt   time.Time
+	manager     *connection.Manager
+	collector   *collector.Collector
+	instances   []config.PostgresInstance
+	supervisors map[string]*postgres.Supervisor
+}
+
+// status returns a snapshot of the agent's state.
+func (s *statusSource) status(ctx context.Context) (any, error) {
+	status := agentStatus{
+		Version:         version,
+		ConfigPath:      s.configPath,
+		StartedAt:       s.startedAt,
+		UptimeSeconds:   time.Since(s.startedAt).Seconds(),
+		State:           s.manager.State().String(),
+		Endpoint:        s.manager.Endpoint(),
+		ServerID:        s.manager.ServerID(),
+		LastMetricsSent: s.manager.LastMetricsSent(),
+		QueuedCommands:  s.manager.QueuedCommands(),
+		Collectors:      s.collector.Status(),
+	}
+	if err := s.manager.Err(); err != nil {
+		status.Error = err.Error()
+	}
+
+	for _, instance := range s.instances {
+		supervisor := s.supervisors[instance.ID]
+		pg := postgresStatus{
+			ID:      instance.ID,
+			Up:      supervisor.DB() != nil,
+			Version: supervisor.Version(),
+		}
+		if err := supervisor.Err(); err != nil {
+			pg.Error = err.Error()
+		}
+		status.Postgres = append(status.Postgres, pg)
+	}
+	return status, nil
+}
+
+// statusCmd implements the 'status' subcommand - shows what the running
+// agent is doing, via its control socket.
+func statusCmd() {
+	statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := statusFlags.String("config", "/etc/deploydb/config.yaml", "Path to configuration file, to find the control socket")
+	socket := statusFlags.String("socket", "", "Control socket of the running agent (overrides control_socket from the config)")
+	asJSON := statusFlags.Bool("json", false, "Print the status as JSON")
+
+	if err := statusFlags.Parse(os.Args[2:]); err != nil {
+		os.Exit(1)
+	}
+
+	path := *socket
+	if path == "" {
+		path = controlSocketPath(*configPath)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var status agentStatus
+	if err := control.Call(ctx, path, "status", &status); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(status)
+		return
+	}
+	printStatus(os.Stdout, status, time.Now())
+}
+
+// controlSocketPath returns control_socket from the config file, or the
+// default if the file cannot be loaded, e.g. because its secrets are only
+// readable by the agent.
+func controlSocketPath(configPath string) string {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return config.DefaultControlSocket
+	}
+	return cfg.ControlSocket
+}
+
+// printStatus writes the status in a human-readable layout.
+func printStatus(w io.Writer, status agentStatus, now time.Time) {
+	uptime := time.Duration(status.UptimeSeconds * float64(time.Second)).Round(time.Second)
+	fmt.Fprintf(w, "deploydb-agent %s, up %s\n\n", status.Version, uptime)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Config:\t%s\n", status.ConfigPath)
+
+	controlPlane := status.State
+	if status.Endpoint != "" {
+		controlPlane += " (" + status.Endpoint + ")"
+	}
+	fmt.Fprintf(tw, "Control plane:\t%s\n", controlPlane)
+	if status.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", status.Error)
+	}
+	if status.ServerID != "" {
+		fmt.Fprintf(tw, "Server ID:\t%s\n", status.ServerID)
+	}
+	fmt.Fprintf(tw, "Last metrics sent:\t%s\n", ago(status.LastMetricsSent, now))
+	fmt.Fprintf(tw, "Queued commands:\t%d\n", status.QueuedCommands)
+
+	for _, pg := range status.Postgres {
+		label := "PostgreSQL:"
+		if pg.ID != "" {
+			label = "PostgreSQL " + pg.ID + ":"
+		}
+		state := "down"
+		if pg.Up {
+			state = "up"
+			// "PostgreSQL 16.2 on x86_64-pc-linux-gnu, compiled by ..."
+			if v, _, _ := strings.Cut(pg.Version, " on "); v != "" {
+				state += ", " + v
+			}
+		} else if pg.Error != "" {
+			state += ": " + pg.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", label, state)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nCollectors:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tSTATUS\tLAST RUN\tDURATION\tMETRICS\tERROR")
+	for _, c := range status.Collectors {
+		state := "ok"
+		switch {
+		case !c.Enabled:
+			state = "disabled"
+		case c.LastRun.IsZero():
+			state = "pending"
+		case c.Error != "":
+			state = "error"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t%s\n",
+			c.Name, state, ago(c.LastRun, now), c.Duration.Round(time.Millisecond), c.Metrics, c.Error)
+	}
+	tw.Flush()
+}
+
+// ago formats how long before now t was, or "never" for the zero time.
+func ago(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return now.Sub(t).Round(time.Second).String() + " ago"
+}
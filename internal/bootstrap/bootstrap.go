@@ -1,7 +1,11 @@
 package bootstrap
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +14,12 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/connection"
+	"github.com/deploydb/agent/internal/identity"
+	"github.com/deploydb/agent/internal/proxy"
+	"github.com/deploydb/agent/internal/tlsconfig"
 )
 
 // BootstrapConfig is the configuration received from the control plane.
@@ -40,27 +50,60 @@ type ProgressUpdate struct {
 	Error   string `json:"error,omitempty"`
 }
 
+// IdentityRegistration registers the agent's identity public key with the
+// control plane.
+type IdentityRegistration struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+
+	// Set in challenge mode, where the token is never sent. TokenProof is
+	// the base64 HMAC-SHA256 of enrollmentMessage keyed by the token.
+	Nonce      string `json:"nonce,omitempty"`
+	TokenProof string `json:"token_proof,omitempty"`
+}
+
+// challengeScheme is the Authorization scheme of requests signed with the
+// identity key.
+const challengeScheme = "DeployDB-Ed25519"
+
 // Bootstrap orchestrates the PostgreSQL installation process.
 type Bootstrap struct {
-	Token          string
+	Token           string
 	ControlPlaneURL string
-	Logger         *slog.Logger
-	HTTPClient     *http.Client
+	Logger          *slog.Logger
+	HTTPClient      *http.Client
+
+	// IdentityPath is where the agent identity keypair is stored.
+	IdentityPath string
+	// AuthMode is connection.AuthBearer (the default) or AuthChallenge, in
+	// which the token never leaves the host and requests are signed with
+	// the identity key instead. It is written to the agent config.
+	AuthMode string
+	// TLS holds the CA bundle and pins used to reach the control plane.
+	// They are written to the agent config; HTTPClient must already be
+	// configured with them.
+	TLS tlsconfig.Options
+	// Proxy is the outbound proxy, written to the agent config when set.
+	Proxy proxy.Config
 
 	// Populated after fetching config
-	Config   *BootstrapResponse
-	OSInfo   *OSInfo
+	Config *BootstrapResponse
+	OSInfo *OSInfo
+
+	identity *identity.Identity
 }
 
 // NewBootstrap creates a new Bootstrap instance.
 func NewBootstrap(token, controlPlaneURL string, logger *slog.Logger) *Bootstrap {
 	return &Bootstrap{
-		Token:          token,
+		Token:           token,
 		ControlPlaneURL: controlPlaneURL,
-		Logger:         logger,
+		Logger:          logger,
 		HTTPClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		IdentityPath: "/etc/deploydb/identity.key",
 	}
 }
 
@@ -85,6 +128,13 @@ func (b *Bootstrap) Run(ctx context.Context) error {
 		return b.fail(ctx, "check_existing", fmt.Errorf("PostgreSQL %s is already installed. Use 'deploydb-agent run' to connect monitoring to existing installation", version))
 	}
 
+	// Generate the agent identity and register its public key first: in
+	// challenge mode every later request is signed with it
+	b.Logger.Info("registering agent identity")
+	if err := b.registerIdentity(ctx); err != nil {
+		return b.fail(ctx, "register_identity", err)
+	}
+
 	// Step 3: Fetch configuration from control plane
 	b.Logger.Info("fetching configuration from control plane")
 	if err := b.reportProgress(ctx, "fetch_config", "bootstrapping", "Fetching configuration..."); err != nil {
@@ -179,9 +229,7 @@ func (b *Bootstrap) Run(ctx context.Context) error {
 
 // fetchConfig retrieves the bootstrap configuration from the control plane.
 func (b *Bootstrap) fetchConfig(ctx context.Context) (*BootstrapResponse, error) {
-	url := fmt.Sprintf("%s/api/v1/bootstrap/config?token=%s", b.ControlPlaneURL, b.Token)
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := b.newRequest(ctx, "GET", "/api/v1/bootstrap/config", nil)
 	if err != nil {
 		return nil, fmt.Errorf("create request: %w", err)
 	}
@@ -210,10 +258,128 @@ func (b *Bootstrap) fetchConfig(ctx context.Context) (*BootstrapResponse, error)
 	return &config, nil
 }
 
+// registerIdentity creates the agent identity keypair if needed and
+// registers its public key with the control plane. In challenge mode the
+// key is not known to the control plane yet, so the request also proves
+// the token, bound to this key and nonce, without sending it.
+func (b *Bootstrap) registerIdentity(ctx context.Context) error {
+	id, err := identity.LoadOrCreate(b.IdentityPath)
+	if err != nil {
+		return err
+	}
+	b.identity = id
+
+	registration := IdentityRegistration{
+		Algorithm: identity.Algorithm,
+		KeyID:     id.KeyID(),
+		PublicKey: id.PublicKey(),
+	}
+	if b.AuthMode == connection.AuthChallenge {
+		nonce, err := b.challenge(ctx)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha256.New, []byte(b.Token))
+		mac.Write(enrollmentMessage(nonce, id.PublicKey()))
+		registration.Nonce = nonce
+		registration.TokenProof = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	req, err := b.newRequestWithNonce(ctx, "POST", "/api/v1/bootstrap/identity", bytes.NewReader(body), registration.Nonce)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("control plane returned %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	b.Logger.Info("agent identity registered", "key_id", id.KeyID())
+	return nil
+}
+
+// enrollmentMessage returns the bytes TokenProof covers.
+func enrollmentMessage(nonce, publicKey string) []byte {
+	return []byte("deploydb-agent-enroll\n" + nonce + "\n" + publicKey)
+}
+
+// challenge fetches a single-use nonce for a signed request.
+func (b *Bootstrap) challenge(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.ControlPlaneURL+"/api/v1/bootstrap/challenge", nil)
+	if err != nil {
+		return "", fmt.Errorf("create challenge request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := b.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request challenge: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("control plane returned %d for challenge: %s", resp.StatusCode, string(respBody))
+	}
+	var challenge connection.AuthChallengePayload
+	if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+		return "", fmt.Errorf("parse challenge: %w", err)
+	}
+	if challenge.Nonce == "" {
+		return "", fmt.Errorf("challenge has no nonce")
+	}
+	return challenge.Nonce, nil
+}
+
+// newRequest creates an authenticated control plane API request. The
+// credentials go in the Authorization header so they never appear in proxy
+// or load balancer access logs; in challenge mode each request answers a
+// fresh nonce.
+func (b *Bootstrap) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	var nonce string
+	if b.AuthMode == connection.AuthChallenge {
+		if b.identity == nil {
+			return nil, connection.ErrIdentityRequired
+		}
+		var err error
+		if nonce, err = b.challenge(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return b.newRequestWithNonce(ctx, method, path, body, nonce)
+}
+
+// newRequestWithNonce creates a request carrying the bootstrap token, or in
+// challenge mode the identity key's signature of nonce.
+func (b *Bootstrap) newRequestWithNonce(ctx context.Context, method, path string, body io.Reader, nonce string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.ControlPlaneURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if b.AuthMode == connection.AuthChallenge {
+		req.Header.Set("Authorization", fmt.Sprintf("%s key_id=%q, nonce=%q, signature=%q",
+			challengeScheme, b.identity.KeyID(), nonce, b.identity.SignChallenge(nonce)))
+	} else {
+		req.Header.Set("Authorization", "Bearer "+b.Token)
+	}
+	return req, nil
+}
+
 // reportProgress sends a progress update to the control plane.
 func (b *Bootstrap) reportProgress(ctx context.Context, step, status, message string) error {
-	url := fmt.Sprintf("%s/api/v1/bootstrap/progress?token=%s", b.ControlPlaneURL, b.Token)
-
 	update := ProgressUpdate{
 		Step:    step,
 		Status:  status,
@@ -225,7 +391,7 @@ func (b *Bootstrap) reportProgress(ctx context.Context, step, status, message st
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url,
+	req, err := b.newRequest(ctx, "POST", "/api/v1/bootstrap/progress",
 		io.NopCloser(strings.NewReader(string(body))))
 	if err != nil {
 		return err
@@ -253,9 +419,8 @@ func (b *Bootstrap) fail(ctx context.Context, step string, err error) error {
 	}
 
 	body, _ := json.Marshal(update)
-	url := fmt.Sprintf("%s/api/v1/bootstrap/progress?token=%s", b.ControlPlaneURL, b.Token)
 
-	req, reqErr := http.NewRequestWithContext(ctx, "POST", url,
+	req, reqErr := b.newRequest(ctx, "POST", "/api/v1/bootstrap/progress",
 		io.NopCloser(strings.NewReader(string(body))))
 	if reqErr == nil {
 		req.Header.Set("Content-Type", "application/json")
@@ -364,42 +529,63 @@ func (b *Bootstrap) writeAgentConfig(ctx context.Context) error {
 		return fmt.Errorf("create config dir: %w", err)
 	}
 
-	// Determine PostgreSQL connection details
-	pgHost := "localhost"
-	pgPort := b.Config.Config.Port
-	if pgPort == 0 {
-		pgPort = 5432
+	cfg := b.agentConfig()
+	data, err := cfg.Marshal()
+	if err != nil {
+		return fmt.Errorf("encode config: %w", err)
 	}
 
-	config := fmt.Sprintf(`# DeployDB Agent Configuration
-# Generated by bootstrap on %s
-
-control_plane:
-  url: %s/cable
-  token: %s
-
-postgres:
-  host: %s
-  port: %d
-  user: postgres
-  database: postgres
-
-metrics:
-  interval: 30s
-
-log_level: info
-`,
-		time.Now().Format(time.RFC3339),
-		b.ControlPlaneURL,
-		b.Config.Token,
-		pgHost,
-		pgPort,
-	)
-
-	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+	header := fmt.Sprintf("# DeployDB Agent Configuration\n# Generated by bootstrap on %s\n\n", time.Now().Format(time.RFC3339))
+	if err := os.WriteFile(configFile, append([]byte(header), data...), 0600); err != nil {
 		return fmt.Errorf("write config file: %w", err)
 	}
 
 	b.Logger.Info("agent configuration written", "path", configFile)
 	return nil
 }
+
+// agentConfig returns the agent configuration for the bootstrapped server.
+// Settings left unset take their defaults when the agent loads the file.
+func (b *Bootstrap) agentConfig() *config.Config {
+	pgPort := b.Config.Config.Port
+	if pgPort == 0 {
+		pgPort = 5432
+	}
+
+	return &config.Config{
+		ControlPlaneURL: websocketURL(b.ControlPlaneURL) + "/cable",
+		Token:           b.Config.Token,
+		AuthMode:        b.AuthMode,
+		IdentityKey:     b.IdentityPath,
+		ControlPlaneTLS: config.ClientTLS{
+			CAFile: b.TLS.CAFile,
+			Pins:   b.TLS.Pins,
+		},
+		Proxy: config.ProxyConfig{
+			URL:     b.Proxy.URL,
+			NoProxy: b.Proxy.NoProxy,
+		},
+		Postgres: config.PostgresConfig{
+			Host:     "localhost",
+			Port:     pgPort,
+			User:     "postgres",
+			Database: "postgres",
+		},
+		MetricsInterval: 30 * time.Second,
+		LogLevel:        "info",
+	}
+}
+
+// websocketURL converts the control plane's HTTP base URL to the
+// corresponding WebSocket URL.
+func websocketURL(base string) string {
+	base = strings.TrimSuffix(base, "/")
+	switch {
+	case strings.HasPrefix(base, "https://"):
+		return "wss://" + strings.TrimPrefix(base, "https://")
+	case strings.HasPrefix(base, "http://"):
+		return "ws://" + strings.TrimPrefix(base, "http://")
+	default:
+		return base
+	}
+}
@@ -0,0 +1,199 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/connection"
+	"github.com/deploydb/agent/internal/identity"
+	"github.com/deploydb/agent/internal/tlsconfig"
+)
+
+func TestFetchConfig_SendsTokenInHeader(t *testing.T) {
+	var gotAuth, gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotQuery = r.URL.RawQuery
+		json.NewEncoder(w).Encode(BootstrapResponse{
+			ServerID:   42,
+			ServerName: "db-1",
+			Token:      "ddb_server_token",
+		})
+	}))
+	defer server.Close()
+
+	b := NewBootstrap("ddb_bootstrap_token", server.URL, slog.Default())
+
+	resp, err := b.fetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("fetchConfig() error = %v", err)
+	}
+
+	if resp.ServerName != "db-1" {
+		t.Errorf("ServerName = %v, want %v", resp.ServerName, "db-1")
+	}
+	if gotAuth != "Bearer ddb_bootstrap_token" {
+		t.Errorf("Authorization = %v, want %v", gotAuth, "Bearer ddb_bootstrap_token")
+	}
+	if gotQuery != "" {
+		t.Errorf("query string = %q, want empty", gotQuery)
+	}
+}
+
+func TestRegisterIdentity(t *testing.T) {
+	var got IdentityRegistration
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	b := NewBootstrap("ddb_bootstrap_token", server.URL, slog.Default())
+	b.IdentityPath = filepath.Join(t.TempDir(), "identity.key")
+
+	if err := b.registerIdentity(context.Background()); err != nil {
+		t.Fatalf("registerIdentity() error = %v", err)
+	}
+
+	if gotPath != "/api/v1/bootstrap/identity" {
+		t.Errorf("path = %v, want /api/v1/bootstrap/identity", gotPath)
+	}
+
+	id, err := identity.Load(b.IdentityPath)
+	if err != nil {
+		t.Fatalf("identity key not stored: %v", err)
+	}
+	if got.PublicKey != id.PublicKey() || got.KeyID != id.KeyID() {
+		t.Errorf("registered %+v, want key %s", got, id.KeyID())
+	}
+	if got.Algorithm != identity.Algorithm {
+		t.Errorf("Algorithm = %v, want %v", got.Algorithm, identity.Algorithm)
+	}
+
+	info, _ := os.Stat(b.IdentityPath)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %o, want 600", info.Mode().Perm())
+	}
+}
+
+func TestBootstrap_ChallengeMode(t *testing.T) {
+	const token = "ddb_bootstrap_token"
+	var (
+		mu           sync.Mutex
+		nonces       int
+		registration IdentityRegistration
+		configAuth   string
+		leaked       []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(fmt.Sprint(r.Header), token) || strings.Contains(string(body), token) {
+			leaked = append(leaked, r.URL.Path)
+		}
+
+		switch r.URL.Path {
+		case "/api/v1/bootstrap/challenge":
+			nonces++
+			json.NewEncoder(w).Encode(map[string]string{"nonce": fmt.Sprintf("nonce-%d", nonces)})
+		case "/api/v1/bootstrap/identity":
+			json.Unmarshal(body, &registration)
+			w.WriteHeader(http.StatusCreated)
+		case "/api/v1/bootstrap/config":
+			configAuth = r.Header.Get("Authorization")
+			json.NewEncoder(w).Encode(BootstrapResponse{ServerName: "db-1"})
+		}
+	}))
+	defer server.Close()
+
+	b := NewBootstrap(token, server.URL, slog.Default())
+	b.AuthMode = connection.AuthChallenge
+	b.IdentityPath = filepath.Join(t.TempDir(), "identity.key")
+
+	// Nothing can be signed before the identity exists
+	if _, err := b.fetchConfig(context.Background()); !errors.Is(err, connection.ErrIdentityRequired) {
+		t.Fatalf("fetchConfig() before registerIdentity() error = %v, want ErrIdentityRequired", err)
+	}
+	if err := b.registerIdentity(context.Background()); err != nil {
+		t.Fatalf("registerIdentity() error = %v", err)
+	}
+	if _, err := b.fetchConfig(context.Background()); err != nil {
+		t.Fatalf("fetchConfig() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("token sent to %v", leaked)
+	}
+
+	// Registration proves the token, bound to the nonce and key
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(enrollmentMessage(registration.Nonce, registration.PublicKey))
+	if registration.Nonce == "" || registration.TokenProof != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("registration = %+v, want a token proof over its nonce and key", registration)
+	}
+
+	// Later requests are signed with the registered key over a fresh nonce
+	const nonce = "nonce-2"
+	var keyID, gotNonce, signature string
+	if _, err := fmt.Sscanf(configAuth, challengeScheme+" key_id=%q, nonce=%q, signature=%q", &keyID, &gotNonce, &signature); err != nil {
+		t.Fatalf("Authorization = %q: %v", configAuth, err)
+	}
+	if keyID != registration.KeyID || gotNonce != nonce {
+		t.Errorf("Authorization key_id = %s, nonce = %s, want %s and %s", keyID, gotNonce, registration.KeyID, nonce)
+	}
+	if !identity.Verify(registration.PublicKey, identity.ChallengeMessage(nonce), signature) {
+		t.Error("config request signature does not verify against the registered key")
+	}
+}
+
+func TestAgentConfig_IsLoadable(t *testing.T) {
+	b := NewBootstrap("ddb_bootstrap_token", "https://app.deploydb.com/", slog.Default())
+	b.Config = &BootstrapResponse{Token: "ddb_server_token", Config: BootstrapConfig{Port: 5433}}
+	b.TLS = tlsconfig.Options{Pins: []string{"sha256/" + strings.Repeat("A", 43) + "="}}
+
+	data, err := b.agentConfig().Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("config.Load() of bootstrapped config error = %v\n%s", err, data)
+	}
+	if cfg.ControlPlaneURL != "wss://app.deploydb.com/cable" {
+		t.Errorf("ControlPlaneURL = %v, want wss://app.deploydb.com/cable", cfg.ControlPlaneURL)
+	}
+	if cfg.Token != "ddb_server_token" {
+		t.Errorf("Token = %v, want ddb_server_token", cfg.Token)
+	}
+	if cfg.Postgres.Port != 5433 {
+		t.Errorf("Postgres.Port = %v, want 5433", cfg.Postgres.Port)
+	}
+	if len(cfg.ControlPlaneTLS.Pins) != 1 {
+		t.Errorf("Pins = %v, want the bootstrap pin", cfg.ControlPlaneTLS.Pins)
+	}
+}
@@ -58,6 +58,7 @@ func (p *ProgressReporter) Report(status, step, message string, percent int, sys
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+p.token)
 
 	resp, err := p.client.Do(httpReq)
 	if err != nil {
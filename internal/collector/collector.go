@@ -4,84 +4,321 @@ package collector
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
+// Names of the individual collectors, as used by SetEnabled.
+const (
+	CollectorPostgres         = "postgres"
+	CollectorPostgresExtended = "postgres_extended"
+	CollectorSystem           = "system"
+	CollectorDisk             = "disk"
+)
+
+// Collectors lists every collector name in collection order.
+var Collectors = []string{
+	CollectorPostgres,
+	CollectorPostgresExtended,
+	CollectorSystem,
+	CollectorDisk,
+}
+
 // Config holds collector configuration.
 type Config struct {
 	DB      *sql.DB
-	DataDir string // PostgreSQL data directory for disk metrics
+	DataDir string // Overrides the data directory reported by PostgreSQL
+
+	// Instances monitors several PostgreSQL clusters, replacing DB and
+	// DataDir.
+	Instances []Instance
+}
+
+// Instance is one PostgreSQL cluster. Its PostgreSQL and disk metrics are
+// labeled with LabelInstance, unless ID is empty.
+type Instance struct {
+	ID string
+	DB *sql.DB
+
+	// DataDir overrides the data directory reported by the server. See
+	// instancePaths for how it is found otherwise.
+	DataDir string
+}
+
+// labels returns the labels added to the instance's metrics.
+func (i Instance) labels() []Label {
+	if i.ID == "" {
+		return nil
+	}
+	return []Label{{Name: LabelInstance, Value: i.ID}}
 }
 
 // Collector collects metrics from PostgreSQL and the system.
 type Collector struct {
-	config Config
+	instances []Instance
+	mu        sync.RWMutex
+	disabled  map[string]bool
+	status    map[string]Status
 }
 
 // New creates a new Collector.
 func New(config Config) *Collector {
-	if config.DataDir == "" {
-		config.DataDir = "/var/lib/postgresql"
+	instances := append([]Instance(nil), config.Instances...)
+	if len(instances) == 0 {
+		instances = []Instance{{DB: config.DB, DataDir: config.DataDir}}
 	}
-	return &Collector{config: config}
+	return &Collector{
+		instances: instances,
+		disabled:  make(map[string]bool),
+		status:    make(map[string]Status),
+	}
+}
+
+// SetEnabled enables or disables an individual collector by name.
+func (c *Collector) SetEnabled(name string, enabled bool) error {
+	if !IsCollector(name) {
+		return fmt.Errorf("unknown collector: %s", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disabled[name] = !enabled
+	return nil
+}
+
+// Enabled returns the enabled state of every collector.
+func (c *Collector) Enabled() map[string]bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	enabled := make(map[string]bool, len(Collectors))
+	for _, name := range Collectors {
+		enabled[name] = !c.disabled[name]
+	}
+	return enabled
+}
+
+// SetDB replaces the PostgreSQL connection of an instance, for example
+// after the DSN changed. A nil DB disables the instance's PostgreSQL
+// metrics.
+func (c *Collector) SetDB(id string, db *sql.DB) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.instances {
+		if c.instances[i].ID == id {
+			c.instances[i].DB = db
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown instance: %s", id)
+}
+
+// SetDataDir replaces the configured data directory of an instance. An
+// empty dir falls back to the one reported by the server.
+func (c *Collector) SetDataDir(id, dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.instances {
+		if c.instances[i].ID == id {
+			c.instances[i].DataDir = dir
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown instance: %s", id)
+}
+
+// DB returns the PostgreSQL connection of an instance, or nil.
+func (c *Collector) DB(id string) *sql.DB {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, instance := range c.instances {
+		if instance.ID == id {
+			return instance.DB
+		}
+	}
+	return nil
+}
+
+// Instances returns the monitored instances.
+func (c *Collector) Instances() []Instance {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Instance(nil), c.instances...)
+}
+
+// IsCollector reports whether name is a known collector.
+func IsCollector(name string) bool {
+	for _, n := range Collectors {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isEnabled reports whether the named collector is enabled.
+func (c *Collector) isEnabled(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.disabled[name]
 }
 
 // Collect collects all metrics (PostgreSQL + system).
 func (c *Collector) Collect(ctx context.Context) (map[string]float64, error) {
 	metrics := make(map[string]float64)
 
-	// Collect PostgreSQL metrics if DB is configured
-	if c.config.DB != nil {
-		pgMetrics, err := c.CollectPostgres(ctx)
+	for _, name := range Collectors {
+		if !c.isEnabled(name) {
+			continue
+		}
+		result, err := c.Run(ctx, name)
 		if err != nil {
-			return nil, fmt.Errorf("postgres metrics: %w", err)
+			switch name {
+			case CollectorPostgres:
+				// Instances that failed are left out
+				if len(result) == 0 {
+					return nil, fmt.Errorf("postgres metrics: %w", err)
+				}
+			case CollectorSystem:
+				return nil, fmt.Errorf("system metrics: %w", err)
+			}
+			// Extended and disk metrics are optional, keep what succeeded
 		}
-		for k, v := range pgMetrics {
+		for k, v := range result {
 			metrics[k] = v
 		}
+	}
 
-		// Also collect extended metrics
-		extMetrics, err := c.CollectPostgresExtended(ctx)
-		if err != nil {
-			// Extended metrics are optional, just log and continue
-			_ = err
-		} else {
-			for k, v := range extMetrics {
-				metrics[k] = v
-			}
-		}
+	return metrics, nil
+}
+
+// Run runs a single collector, whether or not it is enabled, and records
+// the outcome for Status.
+func (c *Collector) Run(ctx context.Context, name string) (map[string]float64, error) {
+	start := time.Now()
+
+	var metrics map[string]float64
+	var err error
+	switch name {
+	case CollectorPostgres:
+		metrics, err = c.CollectPostgres(ctx)
+	case CollectorPostgresExtended:
+		metrics, err = c.CollectPostgresExtended(ctx)
+	case CollectorSystem:
+		metrics, err = c.CollectSystem()
+	case CollectorDisk:
+		metrics, err = c.CollectDisk(ctx)
+	default:
+		return nil, fmt.Errorf("unknown collector: %s", name)
 	}
 
-	// Collect system metrics
-	sysMetrics, err := c.CollectSystem()
+	status := Status{
+		Name:     name,
+		LastRun:  start,
+		Duration: time.Since(start),
+		Metrics:  len(metrics),
+	}
 	if err != nil {
-		return nil, fmt.Errorf("system metrics: %w", err)
+		status.Error = err.Error()
 	}
-	for k, v := range sysMetrics {
-		metrics[k] = v
+	c.mu.Lock()
+	c.status[name] = status
+	c.mu.Unlock()
+
+	return metrics, err
+}
+
+// Status is the outcome of a collector's last run.
+type Status struct {
+	Name     string        `json:"name"`
+	Enabled  bool          `json:"enabled"`
+	LastRun  time.Time     `json:"last_run,omitzero"`
+	Duration time.Duration `json:"duration_ns"`
+	Metrics  int           `json:"metrics"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Status returns the last run of every collector, in collection order.
+// Collectors that have not run yet have a zero LastRun.
+func (c *Collector) Status() []Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	statuses := make([]Status, len(Collectors))
+	for i, name := range Collectors {
+		status := c.status[name]
+		status.Name = name
+		status.Enabled = !c.disabled[name]
+		statuses[i] = status
 	}
+	return statuses
+}
 
-	// Collect disk metrics
-	diskMetrics, err := c.CollectDisk()
-	if err != nil {
-		// Disk metrics are optional
-		_ = err
-	} else {
+// CollectPostgres collects essential PostgreSQL metrics from every
+// instance. Metrics of instances that failed are left out and their errors
+// joined.
+func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, error) {
+	return c.eachInstance(ctx, collectPostgres)
+}
+
+// CollectPostgresExtended collects extended PostgreSQL metrics from every
+// instance, like CollectPostgres.
+func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]float64, error) {
+	return c.eachInstance(ctx, collectPostgresExtended)
+}
+
+// CollectDisk collects disk metrics for the filesystems of every instance.
+// See collectInstanceDisk.
+func (c *Collector) CollectDisk(ctx context.Context) (map[string]float64, error) {
+	var errs []error
+	metrics := make(map[string]float64)
+	for _, instance := range c.Instances() {
+		diskMetrics, err := collectInstanceDisk(ctx, instance)
+		if err != nil {
+			errs = append(errs, instanceError(instance, err))
+		}
 		for k, v := range diskMetrics {
 			metrics[k] = v
 		}
 	}
+	return metrics, errors.Join(errs...)
+}
 
-	return metrics, nil
+// eachInstance runs collect against every instance that has a DB.
+func (c *Collector) eachInstance(ctx context.Context, collect func(context.Context, *sql.DB) (map[string]float64, error)) (map[string]float64, error) {
+	var errs []error
+	metrics := make(map[string]float64)
+	for _, instance := range c.Instances() {
+		if instance.DB == nil {
+			continue
+		}
+		instanceMetrics, err := collect(ctx, instance.DB)
+		if err != nil {
+			errs = append(errs, instanceError(instance, err))
+			continue
+		}
+		withLabels(metrics, instanceMetrics, instance.labels()...)
+	}
+	return metrics, errors.Join(errs...)
 }
 
-// CollectPostgres collects essential PostgreSQL metrics.
-func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, error) {
+// instanceError names the instance in err when there are several.
+func instanceError(instance Instance, err error) error {
+	if instance.ID == "" {
+		return err
+	}
+	return fmt.Errorf("instance %s: %w", instance.ID, err)
+}
+
+// collectPostgres collects essential PostgreSQL metrics from one database.
+func collectPostgres(ctx context.Context, db *sql.DB) (map[string]float64, error) {
 	metrics := make(map[string]float64)
 
 	// Active connections
 	var active float64
-	err := c.config.DB.QueryRowContext(ctx,
+	err := db.QueryRowContext(ctx,
 		"SELECT count(*) FROM pg_stat_activity WHERE state != 'idle' AND pid != pg_backend_pid()").Scan(&active)
 	if err != nil {
 		return nil, fmt.Errorf("pg_connections_active: %w", err)
@@ -90,7 +327,7 @@ func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, er
 
 	// Idle connections
 	var idle float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT count(*) FROM pg_stat_activity WHERE state = 'idle'").Scan(&idle)
 	if err != nil {
 		return nil, fmt.Errorf("pg_connections_idle: %w", err)
@@ -99,7 +336,7 @@ func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, er
 
 	// Total connections
 	var total float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT count(*) FROM pg_stat_activity WHERE pid != pg_backend_pid()").Scan(&total)
 	if err != nil {
 		return nil, fmt.Errorf("pg_connections_total: %w", err)
@@ -108,7 +345,7 @@ func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, er
 
 	// Max connections
 	var maxConn float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT setting::float FROM pg_settings WHERE name = 'max_connections'").Scan(&maxConn)
 	if err != nil {
 		return nil, fmt.Errorf("pg_connections_max: %w", err)
@@ -120,7 +357,7 @@ func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, er
 
 	// Database size (sum of all non-template databases)
 	var dbSize float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT COALESCE(sum(pg_database_size(datname)), 0) FROM pg_database WHERE datistemplate = false").Scan(&dbSize)
 	if err != nil {
 		return nil, fmt.Errorf("pg_database_size_bytes: %w", err)
@@ -130,13 +367,14 @@ func (c *Collector) CollectPostgres(ctx context.Context) (map[string]float64, er
 	return metrics, nil
 }
 
-// CollectPostgresExtended collects extended PostgreSQL metrics.
-func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]float64, error) {
+// collectPostgresExtended collects extended PostgreSQL metrics from one
+// database.
+func collectPostgresExtended(ctx context.Context, db *sql.DB) (map[string]float64, error) {
 	metrics := make(map[string]float64)
 
 	// Uptime
 	var uptime float64
-	err := c.config.DB.QueryRowContext(ctx,
+	err := db.QueryRowContext(ctx,
 		"SELECT EXTRACT(EPOCH FROM (now() - pg_postmaster_start_time()))").Scan(&uptime)
 	if err != nil {
 		return nil, fmt.Errorf("pg_uptime_seconds: %w", err)
@@ -145,7 +383,7 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 
 	// Cache hit ratio
 	var cacheHitRatio float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		`SELECT CASE WHEN sum(blks_hit) + sum(blks_read) = 0 THEN 1.0
 		 ELSE sum(blks_hit)::float / (sum(blks_hit) + sum(blks_read)) END
 		 FROM pg_stat_database`).Scan(&cacheHitRatio)
@@ -156,7 +394,7 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 
 	// Deadlocks total
 	var deadlocks float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT COALESCE(sum(deadlocks), 0) FROM pg_stat_database").Scan(&deadlocks)
 	if err != nil {
 		return nil, fmt.Errorf("pg_deadlocks_total: %w", err)
@@ -165,7 +403,7 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 
 	// Oldest transaction age
 	var oldestTxn sql.NullFloat64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		`SELECT EXTRACT(EPOCH FROM (now() - min(xact_start)))
 		 FROM pg_stat_activity WHERE xact_start IS NOT NULL`).Scan(&oldestTxn)
 	if err != nil {
@@ -179,7 +417,7 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 
 	// Oldest query age
 	var oldestQuery sql.NullFloat64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		`SELECT EXTRACT(EPOCH FROM (now() - min(query_start)))
 		 FROM pg_stat_activity WHERE state = 'active' AND pid != pg_backend_pid()`).Scan(&oldestQuery)
 	if err != nil {
@@ -193,7 +431,7 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 
 	// Waiting queries (lock waits)
 	var waiting float64
-	err = c.config.DB.QueryRowContext(ctx,
+	err = db.QueryRowContext(ctx,
 		"SELECT count(*) FROM pg_stat_activity WHERE wait_event_type = 'Lock'").Scan(&waiting)
 	if err != nil {
 		return nil, fmt.Errorf("pg_waiting_queries: %w", err)
@@ -203,6 +441,6 @@ func (c *Collector) CollectPostgresExtended(ctx context.Context) (map[string]flo
 	return metrics, nil
 }
 
-// CollectSystem and CollectDisk are implemented in platform-specific files:
+// CollectSystem and collectDisk are implemented in platform-specific files:
 // - system_linux.go
 // - system_darwin.go
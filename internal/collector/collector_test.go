@@ -3,6 +3,7 @@ package collector
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"testing"
 	"time"
 
@@ -176,7 +177,7 @@ func TestCollector_DiskMetrics(t *testing.T) {
 		DataDir: "/",
 	})
 
-	metrics, err := collector.CollectDisk()
+	metrics, err := collector.CollectDisk(context.Background())
 	if err != nil {
 		t.Fatalf("CollectDisk() error = %v", err)
 	}
@@ -205,3 +206,100 @@ func TestCollector_DiskMetrics(t *testing.T) {
 		t.Errorf("system_disk_used_percent = %v, want 0-100", metrics["system_disk_used_percent"])
 	}
 }
+
+func TestCollector_SetEnabled(t *testing.T) {
+	collector := New(Config{
+		DataDir: "/",
+	})
+
+	if err := collector.SetEnabled(CollectorDisk, false); err != nil {
+		t.Fatalf("SetEnabled() error = %v", err)
+	}
+	if err := collector.SetEnabled("bogus", false); err == nil {
+		t.Error("SetEnabled() should reject unknown collector")
+	}
+
+	if collector.Enabled()[CollectorDisk] {
+		t.Error("disk collector should be disabled")
+	}
+	if !collector.Enabled()[CollectorSystem] {
+		t.Error("system collector should be enabled")
+	}
+
+	metrics, err := collector.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+
+	if _, ok := metrics["system_disk_total_bytes"]; ok {
+		t.Error("disabled disk collector still produced metrics")
+	}
+	if _, ok := metrics["system_cpu_count"]; !ok {
+		t.Error("missing system_cpu_count from enabled system collector")
+	}
+}
+
+func TestCollector_Status(t *testing.T) {
+	collector := New(Config{DataDir: "/"})
+	collector.SetEnabled(CollectorDisk, false)
+
+	if _, err := collector.Collect(context.Background()); err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+
+	statuses := make(map[string]Status)
+	for _, status := range collector.Status() {
+		statuses[status.Name] = status
+	}
+	if len(statuses) != len(Collectors) {
+		t.Fatalf("Status() returned %d collectors, want %d", len(statuses), len(Collectors))
+	}
+
+	system := statuses[CollectorSystem]
+	if !system.Enabled || system.LastRun.IsZero() || system.Metrics == 0 || system.Error != "" {
+		t.Errorf("system status = %+v, want an enabled successful run", system)
+	}
+	disk := statuses[CollectorDisk]
+	if disk.Enabled || !disk.LastRun.IsZero() {
+		t.Errorf("disk status = %+v, want disabled and never run", disk)
+	}
+
+	if _, err := collector.Run(context.Background(), "bogus"); err == nil {
+		t.Error("Run() should reject unknown collector")
+	}
+}
+
+func TestCollector_Instances(t *testing.T) {
+	collector := New(Config{Instances: []Instance{
+		{ID: "main", DataDir: "/"},
+		{ID: "pg15", DataDir: "/nonexistent"},
+	}})
+
+	metrics, err := collector.CollectDisk(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "instance pg15") {
+		t.Errorf("CollectDisk() error = %v, want one naming pg15", err)
+	}
+	if _, ok := metrics[`system_disk_total_bytes{instance_id="main"}`]; !ok {
+		t.Errorf("missing labeled disk metrics for main: %v", metrics)
+	}
+	if _, ok := metrics["system_disk_total_bytes"]; ok {
+		t.Error("instance metrics should be labeled")
+	}
+
+	// Instances without a DB are skipped
+	if metrics, err := collector.CollectPostgres(context.Background()); err != nil || len(metrics) != 0 {
+		t.Errorf("CollectPostgres() = %v, %v, want nothing", metrics, err)
+	}
+
+	if err := collector.SetDB("other", nil); err == nil {
+		t.Error("SetDB() should reject an unknown instance")
+	}
+
+	// A corrected data directory applies to the next collection
+	if err := collector.SetDataDir("pg15", "/"); err != nil {
+		t.Fatalf("SetDataDir() error = %v", err)
+	}
+	if _, err := collector.CollectDisk(context.Background()); err != nil {
+		t.Errorf("CollectDisk() after SetDataDir error = %v", err)
+	}
+}
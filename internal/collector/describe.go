@@ -0,0 +1,84 @@
+package collector
+
+// MetricType is the kind of a metric, as understood by Prometheus and OTLP.
+type MetricType string
+
+const (
+	// Gauge is a value that can go up and down.
+	Gauge MetricType = "gauge"
+	// Counter is a cumulative value that only increases (until a restart).
+	Counter MetricType = "counter"
+)
+
+// MetricDesc describes a metric produced by the collector.
+type MetricDesc struct {
+	Help string
+	Type MetricType
+	Unit string
+}
+
+// descriptions documents every metric the agent reports.
+var descriptions = map[string]MetricDesc{
+	// PostgreSQL connection
+	"pg_up":                      {Help: "Whether the agent is connected to PostgreSQL (0 or 1).", Type: Gauge},
+	"pg_connection_errors_total": {Help: "Failed PostgreSQL connection attempts and health checks.", Type: Counter},
+
+	// PostgreSQL essentials
+	"pg_connections_active":    {Help: "Number of non-idle backend connections.", Type: Gauge},
+	"pg_connections_idle":      {Help: "Number of idle backend connections.", Type: Gauge},
+	"pg_connections_total":     {Help: "Total number of backend connections.", Type: Gauge},
+	"pg_connections_max":       {Help: "Configured max_connections.", Type: Gauge},
+	"pg_connections_available": {Help: "Connections available before reaching max_connections.", Type: Gauge},
+	"pg_database_size_bytes":   {Help: "Total size of all non-template databases.", Type: Gauge, Unit: "By"},
+
+	// PostgreSQL extended
+	"pg_uptime_seconds":                 {Help: "Time since the postmaster started.", Type: Gauge, Unit: "s"},
+	"pg_cache_hit_ratio":                {Help: "Buffer cache hit ratio across all databases (0-1).", Type: Gauge, Unit: "1"},
+	"pg_deadlocks_total":                {Help: "Deadlocks detected across all databases.", Type: Counter},
+	"pg_oldest_transaction_age_seconds": {Help: "Age of the oldest open transaction.", Type: Gauge, Unit: "s"},
+	"pg_oldest_query_age_seconds":       {Help: "Age of the oldest active query.", Type: Gauge, Unit: "s"},
+	"pg_waiting_queries":                {Help: "Number of backends waiting on a lock.", Type: Gauge},
+
+	// System
+	"system_cpu_count":              {Help: "Number of logical CPUs.", Type: Gauge},
+	"system_memory_total_bytes":     {Help: "Total physical memory.", Type: Gauge, Unit: "By"},
+	"system_memory_available_bytes": {Help: "Available physical memory.", Type: Gauge, Unit: "By"},
+	"system_memory_used_percent":    {Help: "Percentage of physical memory in use.", Type: Gauge, Unit: "%"},
+	"system_load_1m":                {Help: "1 minute load average.", Type: Gauge},
+	"system_load_5m":                {Help: "5 minute load average.", Type: Gauge},
+	"system_load_15m":               {Help: "15 minute load average.", Type: Gauge},
+
+	// Disk. system_mount_* covers each filesystem holding the data
+	// directory, WAL or a tablespace, labeled mountpoint.
+	"system_disk_total_bytes":      {Help: "Size of the filesystem holding the data directory.", Type: Gauge, Unit: "By"},
+	"system_disk_available_bytes":  {Help: "Space available to unprivileged users on the filesystem holding the data directory.", Type: Gauge, Unit: "By"},
+	"system_disk_used_bytes":       {Help: "Space used on the filesystem holding the data directory.", Type: Gauge, Unit: "By"},
+	"system_disk_used_percent":     {Help: "Percentage of the filesystem holding the data directory in use.", Type: Gauge, Unit: "%"},
+	"system_mount_total_bytes":     {Help: "Size of the filesystem at mountpoint.", Type: Gauge, Unit: "By"},
+	"system_mount_available_bytes": {Help: "Space available to unprivileged users on the filesystem at mountpoint.", Type: Gauge, Unit: "By"},
+	"system_mount_used_bytes":      {Help: "Space used on the filesystem at mountpoint.", Type: Gauge, Unit: "By"},
+	"system_mount_used_percent":    {Help: "Percentage of the filesystem at mountpoint in use.", Type: Gauge, Unit: "%"},
+
+	// Agent
+	"deploydb_agent_control_plane_connected":                {Help: "Whether the agent is connected to the control plane (0 or 1).", Type: Gauge},
+	"deploydb_agent_control_plane_rtt_seconds":              {Help: "Round-trip time of the last WebSocket ping to the control plane.", Type: Gauge, Unit: "s"},
+	"deploydb_agent_control_plane_endpoint_index":           {Help: "Priority index of the control plane endpoint in use (0 is the primary).", Type: Gauge},
+	"deploydb_agent_control_plane_last_receive_age_seconds": {Help: "Time since anything was received from the control plane.", Type: Gauge, Unit: "s"},
+	"deploydb_agent_sent_frames_total":                      {Help: "WebSocket frames sent to the control plane.", Type: Counter},
+	"deploydb_agent_sent_messages_total":                    {Help: "Messages sent to the control plane, counting each message of a batch.", Type: Counter},
+	"deploydb_agent_sent_payload_bytes_total":               {Help: "JSON size of messages sent to the control plane, before encoding and compression.", Type: Counter, Unit: "By"},
+	"deploydb_agent_sent_wire_bytes_total":                  {Help: "Bytes written to the control plane socket.", Type: Counter, Unit: "By"},
+	"deploydb_agent_received_wire_bytes_total":              {Help: "Bytes read from the control plane socket.", Type: Counter, Unit: "By"},
+	"deploydb_agent_send_queue_length":                      {Help: "Messages waiting to be written to the control plane.", Type: Gauge},
+	"deploydb_agent_send_dropped_total":                     {Help: "Messages dropped because the outbound queue was full.", Type: Counter},
+}
+
+// Describe returns the description of a metric or of a labeled series.
+// Metrics without a registered description are reported as gauges.
+func Describe(name string) MetricDesc {
+	name = MetricName(name)
+	if desc, ok := descriptions[name]; ok {
+		return desc
+	}
+	return MetricDesc{Help: name, Type: Gauge}
+}
@@ -0,0 +1,148 @@
+package collector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LabelMountpoint identifies the filesystem of a system_mount_* series.
+const LabelMountpoint = "mountpoint"
+
+// defaultDataDirs are tried in order when the data directory is neither
+// configured nor reported by the server: Debian/Ubuntu, then RHEL.
+var defaultDataDirs = []string{"/var/lib/postgresql", "/var/lib/pgsql"}
+
+// storagePaths are the directories an instance stores data in.
+type storagePaths struct {
+	dataDir     string
+	walDir      string
+	tablespaces []string
+}
+
+// all returns every path, the data directory first.
+func (p storagePaths) all() []string {
+	paths := []string{p.dataDir}
+	if p.walDir != "" {
+		paths = append(paths, p.walDir)
+	}
+	return append(paths, p.tablespaces...)
+}
+
+// instancePaths finds the data directory, WAL directory and tablespaces of
+// an instance. A configured DataDir wins over the one the server reports;
+// without either, the first existing default is used.
+func instancePaths(ctx context.Context, instance Instance) storagePaths {
+	var paths storagePaths
+	if instance.DB != nil {
+		paths = queryPaths(ctx, instance.DB)
+	}
+	if instance.DataDir != "" {
+		paths.dataDir = instance.DataDir
+		paths.walDir = walDir(instance.DataDir, paths.walDir)
+	}
+	if paths.dataDir == "" {
+		paths.dataDir = defaultDataDir()
+	}
+	return paths
+}
+
+// queryPaths asks the server where it stores data. Reading data_directory
+// needs superuser or pg_read_all_settings (part of pg_monitor); what cannot
+// be read is left empty.
+func queryPaths(ctx context.Context, db *sql.DB) storagePaths {
+	var paths storagePaths
+	if err := db.QueryRowContext(ctx, "SHOW data_directory").Scan(&paths.dataDir); err != nil {
+		return paths
+	}
+
+	var version int
+	walName := "pg_wal"
+	if err := db.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err == nil && version < 100000 {
+		walName = "pg_xlog"
+	}
+	paths.walDir = filepath.Join(paths.dataDir, walName)
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT pg_tablespace_location(oid) FROM pg_tablespace WHERE pg_tablespace_location(oid) <> ''")
+	if err != nil {
+		return paths
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var location string
+		if rows.Scan(&location) == nil {
+			paths.tablespaces = append(paths.tablespaces, location)
+		}
+	}
+	return paths
+}
+
+// walDir returns the WAL directory inside dataDir, keeping the name the
+// server uses (pg_wal, or pg_xlog before PostgreSQL 10).
+func walDir(dataDir, reported string) string {
+	name := "pg_wal"
+	if reported != "" {
+		name = filepath.Base(reported)
+	}
+	return filepath.Join(dataDir, name)
+}
+
+// defaultDataDir returns the first default data directory that exists.
+func defaultDataDir() string {
+	for _, dir := range defaultDataDirs {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+	}
+	return defaultDataDirs[0]
+}
+
+// collectInstanceDisk collects disk metrics for an instance: system_disk_*
+// for the filesystem holding the data directory, and system_mount_*
+// labeled with LabelMountpoint for every distinct filesystem holding the
+// data directory, WAL or a tablespace. The names differ so summing
+// system_mount_* counts each filesystem once.
+func collectInstanceDisk(ctx context.Context, instance Instance) (map[string]float64, error) {
+	paths := instancePaths(ctx, instance)
+
+	dataMetrics, err := collectDisk(paths.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]float64)
+	withLabels(metrics, dataMetrics, instance.labels()...)
+
+	var errs []error
+	seen := make(map[string]bool)
+	for _, path := range paths.all() {
+		mount, err := mountPoint(path)
+		if err != nil {
+			// The WAL directory is usually unreadable to the agent; a
+			// pg_wal symlink to another volume cannot be followed then
+			if path != paths.walDir {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if seen[mount] {
+			continue
+		}
+		seen[mount] = true
+
+		mountMetrics, err := collectDisk(mount)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		labels := append(instance.labels(), Label{Name: LabelMountpoint, Value: mount})
+		for name, value := range mountMetrics {
+			name = "system_mount_" + strings.TrimPrefix(name, "system_disk_")
+			metrics[Series(name, labels...)] = value
+		}
+	}
+	return metrics, errors.Join(errs...)
+}
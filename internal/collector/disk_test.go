@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMountPoint(t *testing.T) {
+	if got, err := mountPoint("/"); err != nil || got != "/" {
+		t.Errorf("mountPoint(/) = %q, %v, want /", got, err)
+	}
+
+	dir := t.TempDir()
+	mount, err := mountPoint(dir)
+	if err != nil {
+		t.Fatalf("mountPoint() error = %v", err)
+	}
+	real, _ := filepath.EvalSymlinks(dir)
+	if !strings.HasPrefix(real, mount) {
+		t.Errorf("mountPoint(%s) = %s, want a parent directory", real, mount)
+	}
+
+	// Symlinks are followed to the filesystem they point at
+	link := filepath.Join(dir, "pg_wal")
+	if err := os.Symlink("/", link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if got, _ := mountPoint(link); got != "/" {
+		t.Errorf("mountPoint(link to /) = %q, want /", got)
+	}
+
+	if _, err := mountPoint(filepath.Join(dir, "missing")); err == nil {
+		t.Error("mountPoint() should fail for a missing path")
+	}
+}
+
+func TestInstancePaths(t *testing.T) {
+	// A configured data directory is used as is
+	paths := instancePaths(context.Background(), Instance{DataDir: "/srv/pg/16"})
+	if paths.dataDir != "/srv/pg/16" || paths.walDir != "/srv/pg/16/pg_wal" {
+		t.Errorf("instancePaths() = %+v", paths)
+	}
+
+	// Without a DB or override one of the defaults is used
+	paths = instancePaths(context.Background(), Instance{})
+	if paths.dataDir != defaultDataDirs[0] && paths.dataDir != defaultDataDirs[1] {
+		t.Errorf("dataDir = %q, want one of %v", paths.dataDir, defaultDataDirs)
+	}
+
+	if got := walDir("/srv/pg/9.6", "/var/lib/pgsql/9.6/data/pg_xlog"); got != "/srv/pg/9.6/pg_xlog" {
+		t.Errorf("walDir() = %q, want the reported name in the configured directory", got)
+	}
+}
+
+func TestCollector_DiskPerMount(t *testing.T) {
+	collector := New(Config{Instances: []Instance{{ID: "main", DataDir: "/"}}})
+
+	metrics, err := collector.CollectDisk(context.Background())
+	if err != nil {
+		t.Fatalf("CollectDisk() error = %v", err)
+	}
+
+	for _, series := range []string{
+		`system_disk_total_bytes{instance_id="main"}`,
+		`system_mount_total_bytes{instance_id="main",mountpoint="/"}`,
+	} {
+		if _, ok := metrics[series]; !ok {
+			t.Errorf("missing %s in %v", series, metrics)
+		}
+	}
+
+	// Each filesystem is counted once under system_mount_*
+	for series := range metrics {
+		if MetricName(series) != "system_mount_total_bytes" {
+			continue
+		}
+		if _, labels := ParseSeries(series); len(labels) != 2 {
+			t.Errorf("%s has no mountpoint label", series)
+		}
+	}
+}
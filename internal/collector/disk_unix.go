@@ -0,0 +1,43 @@
+//go:build linux || darwin
+
+package collector
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountPoint returns the mount point of the filesystem holding path, found
+// by walking up from path until the device changes. Symlinks are followed
+// first, so a pg_wal link to another volume resolves to that volume.
+func mountPoint(dir string) (string, error) {
+	path, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("mount point of %s: %w", dir, err)
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return "", fmt.Errorf("stat %s: %w", path, err)
+	}
+	dev := stat.Dev
+
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path, nil
+		}
+		if err := unix.Stat(parent, &stat); err != nil {
+			return "", fmt.Errorf("stat %s: %w", parent, err)
+		}
+		if stat.Dev != dev {
+			return path, nil
+		}
+		path = parent
+	}
+}
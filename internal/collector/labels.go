@@ -0,0 +1,86 @@
+package collector
+
+import "strings"
+
+// LabelInstance identifies the PostgreSQL instance a series belongs to.
+// It is not "instance", which Prometheus reserves for the scrape target.
+const LabelInstance = "instance_id"
+
+// Label is a name/value pair attached to a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Series returns the key of a labeled series in the Prometheus form
+// name{label="value",...}. Without labels it is just the metric name.
+func Series(name string, labels ...Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label.Name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(label.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labelUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n")
+)
+
+// ParseSeries splits a series key built by Series into the metric name and
+// its labels.
+func ParseSeries(series string) (string, []Label) {
+	name, rest, ok := strings.Cut(series, "{")
+	if !ok {
+		return series, nil
+	}
+	rest = strings.TrimSuffix(rest, "}")
+
+	var labels []Label
+	for rest != "" {
+		labelName, value, ok := strings.Cut(rest, `="`)
+		if !ok {
+			break
+		}
+		// Find the closing quote, skipping escaped ones
+		end := 0
+		for end < len(value) && value[end] != '"' {
+			if value[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end > len(value) {
+			end = len(value)
+		}
+		labels = append(labels, Label{Name: labelName, Value: labelUnescaper.Replace(value[:end])})
+		rest = strings.TrimPrefix(value[min(end+1, len(value)):], ",")
+	}
+	return name, labels
+}
+
+// MetricName returns the metric name of a series key, without labels.
+func MetricName(series string) string {
+	name, _, _ := strings.Cut(series, "{")
+	return name
+}
+
+// withLabels copies metrics into out with the labels added to every name.
+func withLabels(out, metrics map[string]float64, labels ...Label) {
+	for name, value := range metrics {
+		out[Series(name, labels...)] = value
+	}
+}
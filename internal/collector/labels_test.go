@@ -0,0 +1,39 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeries(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []Label
+		want   string
+	}{
+		{"pg_up", nil, "pg_up"},
+		{"pg_up", []Label{{LabelInstance, "main"}}, `pg_up{instance_id="main"}`},
+		{"pg_up", []Label{{"a", "1"}, {"b", `say "hi"\n`}}, `pg_up{a="1",b="say \"hi\"\\n"}`},
+	}
+
+	for _, tt := range tests {
+		series := Series(tt.name, tt.labels...)
+		if series != tt.want {
+			t.Errorf("Series() = %s, want %s", series, tt.want)
+		}
+
+		name, labels := ParseSeries(series)
+		if name != tt.name || !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("ParseSeries(%s) = %s, %v, want %s, %v", series, name, labels, tt.name, tt.labels)
+		}
+		if MetricName(series) != tt.name {
+			t.Errorf("MetricName(%s) = %s", series, MetricName(series))
+		}
+	}
+}
+
+func TestDescribe_LabeledSeries(t *testing.T) {
+	if got := Describe(`pg_deadlocks_total{instance_id="main"}`); got.Type != Counter {
+		t.Errorf("Describe() = %+v, want the pg_deadlocks_total description", got)
+	}
+}
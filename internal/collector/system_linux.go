@@ -41,13 +41,13 @@ func (c *Collector) CollectSystem() (map[string]float64, error) {
 	return metrics, nil
 }
 
-// CollectDisk collects disk metrics for the data directory.
-func (c *Collector) CollectDisk() (map[string]float64, error) {
+// collectDisk collects disk metrics for the filesystem holding dataDir.
+func collectDisk(dataDir string) (map[string]float64, error) {
 	metrics := make(map[string]float64)
 
 	var stat unix.Statfs_t
-	if err := unix.Statfs(c.config.DataDir, &stat); err != nil {
-		return nil, fmt.Errorf("statfs %s: %w", c.config.DataDir, err)
+	if err := unix.Statfs(dataDir, &stat); err != nil {
+		return nil, fmt.Errorf("statfs %s: %w", dataDir, err)
 	}
 
 	blockSize := uint64(stat.Bsize)
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -86,6 +87,14 @@ postgres:
 		t.Errorf("LogLevel default = %v, want %v", cfg.LogLevel, "info")
 	}
 
+	if cfg.ControlSocket != DefaultControlSocket {
+		t.Errorf("ControlSocket default = %v, want %v", cfg.ControlSocket, DefaultControlSocket)
+	}
+
+	if cfg.Prometheus.ListenAddress != DefaultPrometheusListenAddress {
+		t.Errorf("Prometheus.ListenAddress default = %v, want %v", cfg.Prometheus.ListenAddress, DefaultPrometheusListenAddress)
+	}
+
 	if cfg.Postgres.Host != "localhost" {
 		t.Errorf("Postgres.Host default = %v, want %v", cfg.Postgres.Host, "localhost")
 	}
@@ -153,6 +162,157 @@ token: "ddb_test"
 postgres:
   user: "agent"
 metrics_interval: 5s
+`,
+			wantErr: true,
+		},
+		{
+			name: "prometheus basic auth without password",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+prometheus:
+  enabled: true
+  basic_auth:
+    username: "prom"
+`,
+			wantErr: true,
+		},
+		{
+			name: "control plane client cert without key",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+control_plane_tls:
+  cert_file: "/etc/deploydb/agent.crt"
+`,
+			wantErr: true,
+		},
+		{
+			name: "malformed certificate pin",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+control_plane_tls:
+  pins: ["md5/abc"]
+`,
+			wantErr: true,
+		},
+		{
+			name: "control plane endpoints",
+			config: `
+control_plane_endpoints:
+  - url: "wss://eu.deploydb.com/agent/ws"
+  - url: "wss://us.deploydb.com/agent/ws"
+    priority: 1
+token: "ddb_test"
+postgres:
+  user: "agent"
+`,
+			wantErr: false,
+		},
+		{
+			name: "control plane url and endpoints",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+control_plane_endpoints:
+  - url: "wss://eu.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+`,
+			wantErr: true,
+		},
+		{
+			name: "prometheus tls without key",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+prometheus:
+  enabled: true
+  tls:
+    cert_file: "/etc/deploydb/exporter.crt"
+`,
+			wantErr: true,
+		},
+		{
+			name: "otlp enabled without endpoint",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+otlp:
+  enabled: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "postgres instances",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres_instances:
+  - id: main
+    user: "agent"
+  - id: pg15
+    user: "agent"
+    port: 5433
+`,
+			wantErr: false,
+		},
+		{
+			name: "postgres and postgres instances",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+postgres_instances:
+  - id: main
+    user: "agent"
+`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate instance id",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres_instances:
+  - id: main
+    user: "agent"
+  - id: main
+    user: "agent"
+    port: 5433
+`,
+			wantErr: true,
+		},
+		{
+			name: "instance id with spaces",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres_instances:
+  - id: "main db"
+    user: "agent"
+`,
+			wantErr: true,
+		},
+		{
+			name: "instance without user",
+			config: `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres_instances:
+  - id: main
 `,
 			wantErr: true,
 		},
@@ -175,21 +335,349 @@ metrics_interval: 5s
 }
 
 func TestPostgresDSN(t *testing.T) {
-	cfg := &Config{
-		Postgres: PostgresConfig{
-			Host:     "db.example.com",
-			Port:     5433,
-			User:     "myuser",
-			Password: "mypass",
-			Database: "mydb",
-			SSLMode:  "require",
+	tests := []struct {
+		name     string
+		postgres PostgresConfig
+		want     string
+	}{
+		{
+			name: "plain values",
+			postgres: PostgresConfig{
+				Host:     "db.example.com",
+				Port:     5433,
+				User:     "myuser",
+				Password: "mypass",
+				Database: "mydb",
+				SSLMode:  "require",
+			},
+			want: "host=db.example.com port=5433 user=myuser dbname=mydb sslmode=require password=mypass",
+		},
+		{
+			name:     "password with spaces and quotes",
+			postgres: PostgresConfig{User: "agent", Password: `it's a "pass" \o/`},
+			want:     `user=agent password='it\'s a "pass" \\o/'`,
+		},
+		{
+			name:     "injection attempt stays one value",
+			postgres: PostgresConfig{User: "agent", Password: "x sslmode=disable"},
+			want:     `user=agent password='x sslmode=disable'`,
+		},
+		{
+			name:     "unset values are left out",
+			postgres: PostgresConfig{Host: "localhost", User: "agent"},
+			want:     "host=localhost user=agent",
+		},
+		{
+			name:     "unix socket",
+			postgres: PostgresConfig{Host: "/var/run/postgresql", Port: 5432, User: "postgres"},
+			want:     "host=/var/run/postgresql port=5432 user=postgres",
 		},
+		{
+			name: "tls files and options",
+			postgres: PostgresConfig{
+				User:               "agent",
+				SSLMode:            "verify-full",
+				SSLRootCert:        "/etc/ssl/pg ca.crt",
+				SSLCert:            "/etc/deploydb/client.crt",
+				SSLKey:             "/etc/deploydb/client.key",
+				ConnectTimeout:     2500 * time.Millisecond,
+				ApplicationName:    DefaultApplicationName,
+				TargetSessionAttrs: "read-write",
+				StatementTimeout:   15 * time.Second,
+			},
+			want: "user=agent sslmode=verify-full sslrootcert='/etc/ssl/pg ca.crt' sslcert=/etc/deploydb/client.crt " +
+				"sslkey=/etc/deploydb/client.key connect_timeout=3 application_name=deploydb-agent " +
+				"options='-c statement_timeout=15000'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.postgres.DSN(); got != tt.want {
+				t.Errorf("DSN() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostgresDefaults(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: "agent"
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := PostgresConfig{
+		Host:               "localhost",
+		Port:               5432,
+		User:               "agent",
+		SSLMode:            "prefer",
+		ConnectTimeout:     10 * time.Second,
+		ApplicationName:    "deploydb-agent",
+		TargetSessionAttrs: "any",
+		StatementTimeout:   30 * time.Second,
+	}
+	if cfg.Postgres != want {
+		t.Errorf("Postgres = %+v, want %+v", cfg.Postgres, want)
+	}
+}
+
+func TestPostgresValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		postgres PostgresConfig
+		wantErr  string
+	}{
+		{"valid", PostgresConfig{User: "agent", SSLMode: "verify-full", TargetSessionAttrs: "primary"}, ""},
+		{"missing user", PostgresConfig{SSLMode: "prefer", TargetSessionAttrs: "any"}, "postgres.user is required"},
+		{"unknown sslmode", PostgresConfig{User: "agent", SSLMode: "on", TargetSessionAttrs: "any"}, "sslmode must be one of"},
+		{"unknown session attrs", PostgresConfig{User: "agent", SSLMode: "prefer", TargetSessionAttrs: "master"}, "target_session_attrs must be one of"},
+		{"cert without key", PostgresConfig{User: "agent", SSLMode: "prefer", TargetSessionAttrs: "any", SSLCert: "c.crt"}, "both sslcert and sslkey"},
+		{"negative statement timeout", PostgresConfig{User: "agent", SSLMode: "prefer", TargetSessionAttrs: "any", StatementTimeout: -time.Second}, "statement_timeout must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.postgres.validate("postgres")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad_PostgresService(t *testing.T) {
+	dir := t.TempDir()
+	serviceFile := filepath.Join(dir, "pg_service.conf")
+	os.WriteFile(serviceFile, []byte(`
+# comment
+[other]
+host=wrong
+
+[monitoring]
+host=/var/run/postgresql
+port=6432
+user=svc_user
+dbname=appdb
+sslmode=disable
+connect_timeout=5
+`), 0600)
+	t.Setenv("PGSERVICEFILE", serviceFile)
+	t.Setenv("PGSYSCONFDIR", dir)
+	t.Setenv("PGPASSFILE", filepath.Join(dir, "missing"))
+
+	cfg, err := Load(writeConfig(t, `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  service: monitoring
+  user: explicit_user
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	pg := cfg.Postgres
+	// Explicit settings win over the service file, which wins over defaults
+	if pg.User != "explicit_user" {
+		t.Errorf("User = %q, want the explicit setting", pg.User)
+	}
+	if pg.Host != "/var/run/postgresql" || pg.Port != 6432 || pg.Database != "appdb" || pg.SSLMode != "disable" {
+		t.Errorf("Postgres = %+v, want the service settings", pg)
+	}
+	if pg.ConnectTimeout != 5*time.Second {
+		t.Errorf("ConnectTimeout = %v, want 5s", pg.ConnectTimeout)
+	}
+
+	_, err = Load(writeConfig(t, `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  service: nonexistent
+  user: agent
+`))
+	if err == nil || !strings.Contains(err.Error(), `service "nonexistent" not found`) {
+		t.Errorf("Load() error = %v, want service not found", err)
+	}
+}
+
+func TestLookupPassfile(t *testing.T) {
+	dir := t.TempDir()
+	passfile := filepath.Join(dir, "pgpass")
+	os.WriteFile(passfile, []byte(`# hostname:port:database:username:password
+db.example.com:5432:*:agent:network
+localhost:5432:postgres:agent:socket\:pass
+*:*:*:other:wildcard
+`), 0600)
+
+	tests := []struct {
+		name     string
+		postgres PostgresConfig
+		want     string
+	}{
+		{"network host", PostgresConfig{Host: "db.example.com", Port: 5432, User: "agent", Database: "any"}, "network"},
+		{"unix socket matches localhost", PostgresConfig{Host: "/tmp", Port: 5432, User: "agent", Database: "postgres"}, "socket:pass"},
+		{"wildcards", PostgresConfig{Host: "h", Port: 1, User: "other"}, "wildcard"},
+		{"no match", PostgresConfig{Host: "db.example.com", Port: 6432, User: "agent"}, ""},
 	}
 
-	dsn := cfg.PostgresDSN()
-	expected := "host=db.example.com port=5433 user=myuser dbname=mydb sslmode=require password=mypass"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.postgres.Passfile = passfile
+			got, err := tt.postgres.lookupPassfile()
+			if err != nil || got != tt.want {
+				t.Errorf("lookupPassfile() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	// Like libpq, a file others can read is ignored
+	os.Chmod(passfile, 0644)
+	pg := PostgresConfig{Host: "db.example.com", Port: 5432, User: "agent", Passfile: passfile}
+	if got, _ := pg.lookupPassfile(); got != "" {
+		t.Errorf("lookupPassfile() = %q from a world-readable file", got)
+	}
+
+	// An explicit passfile must exist
+	pg.Passfile = filepath.Join(dir, "missing")
+	if _, err := pg.lookupPassfile(); err == nil {
+		t.Error("lookupPassfile() should fail for a missing passfile")
+	}
+}
+
+func TestLoad_PasswordFromPGPASSFILE(t *testing.T) {
+	passfile := filepath.Join(t.TempDir(), "pgpass")
+	os.WriteFile(passfile, []byte("localhost:5432:*:agent:from_pgpass\n"), 0600)
+	t.Setenv("PGPASSFILE", passfile)
+
+	cfg, err := Load(writeConfig(t, `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres:
+  user: agent
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Postgres.Password != "from_pgpass" {
+		t.Errorf("Password = %q, want the .pgpass entry", cfg.Postgres.Password)
+	}
+}
+
+func TestInstances(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(passwordFile, []byte("pg15pass\n"), 0600)
+
+	cfg, err := Load(writeConfig(t, `
+control_plane_url: "wss://api.deploydb.com/agent/ws"
+token: "ddb_test"
+postgres_instances:
+  - id: main
+    label: "PostgreSQL 16"
+    user: "agent"
+    data_dir: /var/lib/postgresql/16/main
+  - id: pg15
+    user: "agent"
+    port: 5433
+    password_file: "`+passwordFile+`"
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	instances := cfg.Instances()
+	if len(instances) != 2 {
+		t.Fatalf("Instances() = %+v, want 2", instances)
+	}
+	if instances[0].ID != "main" || instances[0].Label != "PostgreSQL 16" || instances[0].DataDir != "/var/lib/postgresql/16/main" {
+		t.Errorf("instances[0] = %+v", instances[0])
+	}
+	// Connection defaults apply to each instance
+	if instances[0].Host != "localhost" || instances[0].Port != 5432 || instances[1].Port != 5433 {
+		t.Errorf("instances = %+v", instances)
+	}
+	if instances[1].Password != "pg15pass" {
+		t.Errorf("instances[1].Password = %q, want the file contents", instances[1].Password)
+	}
+
+	data, _ := cfg.Redacted().Marshal()
+	if strings.Contains(string(data), "pg15pass") {
+		t.Errorf("redacted dump contains an instance password:\n%s", data)
+	}
+	if cfg.PostgresInstances[1].Password != "pg15pass" {
+		t.Error("Redacted() modified the original instances")
+	}
+
+	// A single postgres block is one unlabeled instance
+	single := &Config{Postgres: PostgresConfig{User: "agent"}}
+	if got := single.Instances(); len(got) != 1 || got[0].ID != "" || got[0].User != "agent" {
+		t.Errorf("Instances() = %+v, want the postgres block", got)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{
+			name: "single url",
+			cfg:  Config{ControlPlaneURL: "wss://a"},
+			want: []string{"wss://a"},
+		},
+		{
+			name: "sorted by priority, stable",
+			cfg: Config{ControlPlaneEndpoints: []EndpointConfig{
+				{URL: "wss://c", Priority: 2},
+				{URL: "wss://a", Priority: 1},
+				{URL: "wss://b", Priority: 1},
+			}},
+			want: []string{"wss://a", "wss://b", "wss://c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cfg.Endpoints()
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Endpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	old := &Config{
+		ControlPlaneURL: "wss://a",
+		Token:           "t1",
+		Postgres:        PostgresConfig{Host: "localhost", Port: 5432},
+		MetricsInterval: time.Minute,
+		ServerID:        "srv_1",
+	}
+
+	same := *old
+	same.ServerID = ""
+	if got := Changed(old, &same); len(got) != 0 {
+		t.Errorf("Changed() = %v, want none; runtime fields are ignored", got)
+	}
 
-	if dsn != expected {
-		t.Errorf("PostgresDSN() = %v, want %v", dsn, expected)
+	updated := *old
+	updated.Token = "t2"
+	updated.Postgres.Port = 6432
+	updated.LogLevel = "debug"
+	got := strings.Join(Changed(old, &updated), " ")
+	if got != "token postgres log_level" {
+		t.Errorf("Changed() = %q, want %q", got, "token postgres log_level")
 	}
 }
@@ -0,0 +1,22 @@
+package config
+
+import "reflect"
+
+// Changed returns the top-level keys whose values differ between two
+// configs, in file order. Runtime fields set by the control plane are
+// ignored.
+func Changed(old, updated *Config) []string {
+	var keys []string
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(updated).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := yamlName(ov.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
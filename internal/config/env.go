@@ -0,0 +1,272 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deploydb/agent/internal/proxy"
+)
+
+// EnvPrefix starts the name of every environment override. The rest of the
+// name is the field's YAML path in upper case joined by underscores, for
+// example DEPLOYDB_POSTGRES_PASSWORD or DEPLOYDB_PROMETHEUS_TLS_CERT_FILE.
+//
+// Lists are comma-separated, maps are comma-separated key=value pairs, and
+// DEPLOYDB_CONTROL_PLANE_ENDPOINTS is a comma-separated list of URLs in
+// priority order. The connection settings of a postgres_instances entry
+// are named after its ID, see instanceEnvPrefix.
+const EnvPrefix = "DEPLOYDB_"
+
+// instanceEnvPrefix returns the prefix of the environment overrides for the
+// postgres_instances entry with the given ID, for example
+// DEPLOYDB_POSTGRES_INSTANCES_PG15_ for ID pg15. Dots and dashes, which
+// environment variable names cannot hold, become underscores.
+func instanceEnvPrefix(id string) string {
+	id = strings.NewReplacer(".", "_", "-", "_").Replace(id)
+	return EnvPrefix + "POSTGRES_INSTANCES_" + strings.ToUpper(id) + "_"
+}
+
+// redactedValue replaces secrets in config dumps.
+const redactedValue = "********"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv overrides fields from environment variables found by lookup.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if err := applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup); err != nil {
+		return err
+	}
+	// Instances are matched by ID; the list itself cannot be overridden
+	for i := range c.PostgresInstances {
+		instance := &c.PostgresInstances[i]
+		if instance.ID == "" {
+			continue
+		}
+		if err := applyEnv(reflect.ValueOf(&instance.PostgresConfig).Elem(), instanceEnvPrefix(instance.ID), lookup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := yamlName(field)
+		if name == "" || field.Tag.Get("env") == "-" {
+			continue
+		}
+
+		key := prefix + strings.ToUpper(name)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := applyEnv(fv, key+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setField(fv, value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		set[name] = true
+	}
+
+	// A secret or its *_file variant from the environment replaces the
+	// other one from the file. Both from the environment still conflict.
+	for name := range set {
+		other := name + "_file"
+		if base, ok := strings.CutSuffix(name, "_file"); ok {
+			other = base
+		}
+		if set[other] {
+			continue
+		}
+		if fv, ok := fieldByYAML(v, other); ok {
+			fv.SetZero()
+		}
+	}
+	return nil
+}
+
+// fieldByYAML returns the field of struct v with the given YAML key.
+func fieldByYAML(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if yamlName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// yamlName returns the YAML key of a struct field, or "" if it is not
+// part of the file.
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+// setField parses value into a config field.
+func setField(fv reflect.Value, value string) error {
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Slice:
+		items := splitList(value)
+		switch fv.Type().Elem() {
+		case reflect.TypeOf(""):
+			fv.Set(reflect.ValueOf(items))
+		case reflect.TypeOf(EndpointConfig{}):
+			endpoints := make([]EndpointConfig, len(items))
+			for i, url := range items {
+				endpoints[i] = EndpointConfig{URL: url, Priority: i}
+			}
+			fv.Set(reflect.ValueOf(endpoints))
+		default:
+			return fmt.Errorf("unsupported list type %s", fv.Type())
+		}
+	case reflect.Map:
+		m := make(map[string]string)
+		for _, pair := range splitList(value) {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		fv.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// readSecretFiles fills secrets from their *_file variants, which usually
+// point at mounted Kubernetes or Docker secrets.
+func (c *Config) readSecretFiles() error {
+	type secretField struct {
+		name  string
+		value *string
+		file  string
+	}
+	secrets := []secretField{
+		{"token", &c.Token, c.TokenFile},
+		{"postgres.password", &c.Postgres.Password, c.Postgres.PasswordFile},
+		{"prometheus.basic_auth.password", &c.Prometheus.BasicAuth.Password, c.Prometheus.BasicAuth.PasswordFile},
+	}
+	for i := range c.PostgresInstances {
+		pg := &c.PostgresInstances[i].PostgresConfig
+		secrets = append(secrets, secretField{fmt.Sprintf("postgres_instances[%d].password", i), &pg.Password, pg.PasswordFile})
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s and %s_file are mutually exclusive", secret.name, secret.name)
+		}
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("reading %s_file: %w", secret.name, err)
+		}
+		*secret.value = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// Redacted returns a copy of the config with secrets masked, safe to log
+// or print.
+func (c *Config) Redacted() *Config {
+	out := *c
+	// Copy so the original instances are untouched
+	out.PostgresInstances = append([]PostgresInstance(nil), c.PostgresInstances...)
+	redact(reflect.ValueOf(&out).Elem())
+	out.Proxy.URL = proxy.Config{URL: c.Proxy.URL}.Redacted()
+	return &out
+}
+
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			redact(fv)
+			continue
+		}
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < fv.Len(); j++ {
+				redact(fv.Index(j))
+			}
+			continue
+		}
+		if field.Tag.Get("secret") != "true" || fv.IsZero() {
+			continue
+		}
+
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(redactedValue)
+		case reflect.Map:
+			// Copy so the original map is untouched
+			masked := reflect.MakeMap(fv.Type())
+			for _, key := range fv.MapKeys() {
+				masked.SetMapIndex(key, reflect.ValueOf(redactedValue))
+			}
+			fv.Set(masked)
+		}
+	}
+}
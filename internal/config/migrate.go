@@ -0,0 +1,196 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the config schema version this agent writes.
+//
+// Version 1 nested the control plane and metrics settings:
+//
+//	control_plane:
+//	  url: wss://...
+//	  token: ddb_...
+//	metrics:
+//	  interval: 30s
+//
+// Version 2 flattened them into control_plane_url, token and
+// metrics_interval. Files without a version are detected by their keys.
+const CurrentVersion = 2
+
+// legacyConfig holds the version 1 keys that were flattened in version 2.
+type legacyConfig struct {
+	ControlPlane struct {
+		URL   string `yaml:"url"`
+		Token string `yaml:"token"`
+	} `yaml:"control_plane"`
+	Metrics struct {
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"metrics"`
+}
+
+// isZero reports whether none of the legacy keys are set.
+func (l *legacyConfig) isZero() bool {
+	return l.ControlPlane.URL == "" && l.ControlPlane.Token == "" && l.Metrics.Interval == 0
+}
+
+// Parse decodes a config file in either layout without applying defaults
+// or validating it. The result is always in the current layout.
+func Parse(data []byte) (*Config, error) {
+	cfg, _, err := parse(data)
+	return cfg, err
+}
+
+// parse is Parse, also reporting whether the file needs migrating.
+func parse(data []byte) (*Config, bool, error) {
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, false, fmt.Errorf("parsing config file: %w", err)
+	}
+	if cfg.Version > CurrentVersion {
+		return nil, false, fmt.Errorf("config version %d is newer than this agent supports (%d)", cfg.Version, CurrentVersion)
+	}
+
+	var legacy legacyConfig
+	if err := yaml.Unmarshal(data, &legacy); err != nil {
+		return nil, false, fmt.Errorf("parsing config file: %w", err)
+	}
+
+	outdated := cfg.Version != CurrentVersion
+	if !legacy.isZero() {
+		if cfg.Version == CurrentVersion {
+			return nil, false, fmt.Errorf("control_plane and metrics sections are not valid in config version %d, use control_plane_url, token and metrics_interval", CurrentVersion)
+		}
+
+		// Flat keys win when a file mixes both layouts
+		if cfg.ControlPlaneURL == "" {
+			cfg.ControlPlaneURL = legacy.ControlPlane.URL
+		}
+		if cfg.Token == "" {
+			cfg.Token = legacy.ControlPlane.Token
+		}
+		if cfg.MetricsInterval == 0 {
+			cfg.MetricsInterval = legacy.Metrics.Interval
+		}
+	}
+
+	cfg.Version = CurrentVersion
+	return cfg, outdated, nil
+}
+
+// Marshal encodes the config in the current layout. Unset fields are
+// omitted so that defaults still apply when it is loaded.
+func (c *Config) Marshal() ([]byte, error) {
+	out := *c
+	out.Version = CurrentVersion
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&out); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Migrate rewrites the config file at path in the current layout, keeping
+// the original as path.bak. It refuses to overwrite an existing backup, and
+// replaces the file atomically so a crash leaves either the old or the new
+// layout. It reports whether anything changed. Comments in the original
+// file are not preserved.
+func Migrate(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("reading config file: %w", err)
+	}
+
+	cfg, outdated, err := parse(data)
+	if err != nil {
+		return false, err
+	}
+	if !outdated {
+		return false, nil
+	}
+
+	migrated, err := cfg.Marshal()
+	if err != nil {
+		return false, fmt.Errorf("encoding config: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if err := writeBackup(path+".bak", data, info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := replaceFile(path, migrated, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("writing config file: %w", err)
+	}
+	return true, nil
+}
+
+// writeBackup writes data to a new file at path, failing if one exists.
+func writeBackup(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("backup %s already exists: move it away and run the migration again", path)
+	}
+	if err != nil {
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	return nil
+}
+
+// replaceFile writes data to a temporary file next to path and renames it
+// over path.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const legacyConfigFile = `
+control_plane:
+  url: wss://app.deploydb.com/cable
+  token: ddb_legacy
+
+postgres:
+  host: localhost
+  port: 5432
+  user: postgres
+  database: postgres
+
+metrics:
+  interval: 45s
+
+log_level: info
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write test config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_LegacyLayout(t *testing.T) {
+	cfg, err := Load(writeConfig(t, legacyConfigFile))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.ControlPlaneURL != "wss://app.deploydb.com/cable" {
+		t.Errorf("ControlPlaneURL = %v", cfg.ControlPlaneURL)
+	}
+	if cfg.Token != "ddb_legacy" {
+		t.Errorf("Token = %v", cfg.Token)
+	}
+	if cfg.MetricsInterval != 45*time.Second {
+		t.Errorf("MetricsInterval = %v, want 45s", cfg.MetricsInterval)
+	}
+	if cfg.Version != CurrentVersion {
+		t.Errorf("Version = %d, want %d", cfg.Version, CurrentVersion)
+	}
+}
+
+func TestParse_Versions(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:   "unversioned flat layout",
+			config: "control_plane_url: wss://a\ntoken: t\n",
+		},
+		{
+			name:    "legacy keys in a current file",
+			config:  "version: 2\ncontrol_plane:\n  url: wss://a\n",
+			wantErr: "not valid in config version 2",
+		},
+		{
+			name:    "newer than supported",
+			config:  "version: 99\n",
+			wantErr: "newer than this agent supports",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.config))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Parse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := writeConfig(t, legacyConfigFile)
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := Migrate(path)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if !changed {
+		t.Fatal("Migrate() should rewrite a legacy file")
+	}
+
+	backup, err := os.ReadFile(path + ".bak")
+	if err != nil || string(backup) != legacyConfigFile {
+		t.Errorf("backup = %q, %v, want the original file", backup, err)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Errorf("Stat() error = %v", err)
+	} else if info.Mode().Perm() != 0640 {
+		t.Errorf("migrated file mode = %v, want 0640", info.Mode().Perm())
+	}
+
+	data, _ := os.ReadFile(path)
+	for _, want := range []string{"version: 2", "control_plane_url: wss://app.deploydb.com/cable", "token: ddb_legacy", "metrics_interval: 45s"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("migrated file missing %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "control_plane:") {
+		t.Errorf("migrated file still has the nested layout:\n%s", data)
+	}
+	// Defaults are not written out
+	if strings.Contains(string(data), "spool") {
+		t.Errorf("migrated file contains unset sections:\n%s", data)
+	}
+
+	if _, err := Load(path); err != nil {
+		t.Errorf("Load() of migrated file error = %v", err)
+	}
+
+	// A second run has nothing to do
+	if changed, err := Migrate(path); err != nil || changed {
+		t.Errorf("second Migrate() = %v, %v, want false, nil", changed, err)
+	}
+
+	// Only the config and its backup are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 2 {
+		t.Errorf("directory has %d entries, want the config and its backup: %v", len(entries), entries)
+	}
+}
+
+func TestMigrate_KeepsExistingBackup(t *testing.T) {
+	path := writeConfig(t, legacyConfigFile)
+	if err := os.WriteFile(path+".bak", []byte("older backup\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := Migrate(path)
+	if err == nil || changed || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Migrate() = %v, %v, want a refusal to overwrite the backup", changed, err)
+	}
+
+	if backup, _ := os.ReadFile(path + ".bak"); string(backup) != "older backup\n" {
+		t.Errorf("backup = %q, want it untouched", backup)
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacyConfigFile {
+		t.Errorf("config = %q, want it untouched", data)
+	}
+}
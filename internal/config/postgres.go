@@ -0,0 +1,404 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultApplicationName identifies the agent's sessions in
+// pg_stat_activity.
+const DefaultApplicationName = "deploydb-agent"
+
+// SSL modes and target session attributes as understood by libpq.
+var (
+	sslModes           = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+	targetSessionAttrs = []string{"any", "read-write", "read-only", "primary", "standby", "prefer-standby"}
+)
+
+// DSN returns a libpq key/value connection string for these settings.
+// Values are quoted as needed, so passwords may contain spaces, quotes and
+// backslashes. Empty settings are left out so libpq defaults apply.
+//
+// target_session_attrs is not included: lib/pq would send it to the server
+// as a runtime parameter. The postgres package checks it after connecting.
+func (p PostgresConfig) DSN() string {
+	var params []string
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+quoteDSNValue(value))
+		}
+	}
+
+	add("host", p.Host)
+	if p.Port != 0 {
+		add("port", strconv.Itoa(p.Port))
+	}
+	add("user", p.User)
+	add("dbname", p.Database)
+	add("sslmode", p.SSLMode)
+	add("sslrootcert", p.SSLRootCert)
+	add("sslcert", p.SSLCert)
+	add("sslkey", p.SSLKey)
+	if p.ConnectTimeout > 0 {
+		// Whole seconds, rounded up so short timeouts do not become "none"
+		add("connect_timeout", strconv.Itoa(int(math.Ceil(p.ConnectTimeout.Seconds()))))
+	}
+	add("application_name", p.ApplicationName)
+	if p.StatementTimeout > 0 {
+		// Passed to the server as a startup option, in milliseconds
+		add("options", fmt.Sprintf("-c statement_timeout=%d", p.StatementTimeout.Milliseconds()))
+	}
+	add("password", p.Password)
+
+	return strings.Join(params, " ")
+}
+
+// quoteDSNValue quotes a connection string value if it is empty or
+// contains whitespace, quotes or backslashes.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r\v\f'\\") {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// IsUnixSocket reports whether Host is a unix socket directory rather
+// than a network host.
+func (p PostgresConfig) IsUnixSocket() bool {
+	return strings.HasPrefix(p.Host, "/") || strings.HasPrefix(p.Host, "@")
+}
+
+// setDefaults applies default connection settings.
+func (p *PostgresConfig) setDefaults() {
+	if p.Host == "" {
+		p.Host = "localhost"
+	}
+	if p.Port == 0 {
+		p.Port = 5432
+	}
+	if p.SSLMode == "" {
+		p.SSLMode = "prefer"
+	}
+	if p.ConnectTimeout == 0 {
+		p.ConnectTimeout = 10 * time.Second
+	}
+	if p.ApplicationName == "" {
+		p.ApplicationName = DefaultApplicationName
+	}
+	if p.TargetSessionAttrs == "" {
+		p.TargetSessionAttrs = "any"
+	}
+	if p.StatementTimeout == 0 {
+		p.StatementTimeout = 30 * time.Second
+	}
+}
+
+// validate checks the connection settings. name prefixes errors.
+func (p *PostgresConfig) validate(name string) error {
+	if p.User == "" {
+		return fmt.Errorf("%s.user is required", name)
+	}
+	if !contains(sslModes, p.SSLMode) {
+		return fmt.Errorf("%s.sslmode must be one of %s", name, strings.Join(sslModes, ", "))
+	}
+	if !contains(targetSessionAttrs, p.TargetSessionAttrs) {
+		return fmt.Errorf("%s.target_session_attrs must be one of %s", name, strings.Join(targetSessionAttrs, ", "))
+	}
+	if (p.SSLCert == "") != (p.SSLKey == "") {
+		return fmt.Errorf("%s requires both sslcert and sslkey", name)
+	}
+	if p.StatementTimeout < 0 {
+		return fmt.Errorf("%s.statement_timeout must not be negative", name)
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// postgresConfigs returns the connection settings in use: the postgres
+// block or every instance.
+func (c *Config) postgresConfigs() []*PostgresConfig {
+	if len(c.PostgresInstances) == 0 {
+		return []*PostgresConfig{&c.Postgres}
+	}
+	configs := make([]*PostgresConfig, len(c.PostgresInstances))
+	for i := range c.PostgresInstances {
+		configs[i] = &c.PostgresInstances[i].PostgresConfig
+	}
+	return configs
+}
+
+// applyServices fills unset settings from pg_service.conf sections. It
+// runs before defaults are applied, so explicit settings win over the
+// service file and the service file over defaults, as in libpq.
+func (c *Config) applyServices() error {
+	for _, p := range c.postgresConfigs() {
+		if p.Service == "" {
+			continue
+		}
+		params, err := lookupService(p.Service)
+		if err != nil {
+			return err
+		}
+		if err := p.applyParams(params); err != nil {
+			return fmt.Errorf("service %s: %w", p.Service, err)
+		}
+	}
+	return nil
+}
+
+// applyParams sets unset fields from libpq connection parameters.
+func (p *PostgresConfig) applyParams(params map[string]string) error {
+	setString := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	for key, value := range params {
+		switch key {
+		case "host", "hostaddr":
+			setString(&p.Host, value)
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid port %q", value)
+			}
+			if p.Port == 0 {
+				p.Port = port
+			}
+		case "user":
+			setString(&p.User, value)
+		case "password":
+			setString(&p.Password, value)
+		case "dbname":
+			setString(&p.Database, value)
+		case "sslmode":
+			setString(&p.SSLMode, value)
+		case "sslrootcert":
+			setString(&p.SSLRootCert, value)
+		case "sslcert":
+			setString(&p.SSLCert, value)
+		case "sslkey":
+			setString(&p.SSLKey, value)
+		case "connect_timeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid connect_timeout %q", value)
+			}
+			if p.ConnectTimeout == 0 {
+				p.ConnectTimeout = time.Duration(seconds) * time.Second
+			}
+		case "application_name":
+			setString(&p.ApplicationName, value)
+		case "target_session_attrs":
+			setString(&p.TargetSessionAttrs, value)
+		case "passfile":
+			setString(&p.Passfile, value)
+		default:
+			return fmt.Errorf("unsupported parameter %q", key)
+		}
+	}
+	return nil
+}
+
+// serviceFiles returns the pg_service.conf files to search, in order:
+// PGSERVICEFILE or ~/.pg_service.conf, then the system-wide file in
+// PGSYSCONFDIR or /etc/postgresql-common.
+func serviceFiles() []string {
+	var files []string
+	if file := os.Getenv("PGSERVICEFILE"); file != "" {
+		files = append(files, file)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+
+	sysconfdir := os.Getenv("PGSYSCONFDIR")
+	if sysconfdir == "" {
+		sysconfdir = "/etc/postgresql-common"
+	}
+	return append(files, filepath.Join(sysconfdir, "pg_service.conf"))
+}
+
+// lookupService returns the parameters of a service from the first
+// service file that defines it.
+func lookupService(name string) (map[string]string, error) {
+	for _, path := range serviceFiles() {
+		params, err := readService(path, name)
+		if err != nil {
+			return nil, err
+		}
+		if params != nil {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("service %q not found in %s", name, strings.Join(serviceFiles(), " or "))
+}
+
+// readService reads one section of a service file. It returns nil if the
+// file or the section does not exist.
+func readService(path, name string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading service file: %w", err)
+	}
+	defer f.Close()
+
+	var params map[string]string
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if inSection {
+				break
+			}
+			inSection = line[1:len(line)-1] == name
+			if inSection {
+				params = make(map[string]string)
+			}
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key=value", path, lineNo)
+		}
+		params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading service file: %w", err)
+	}
+	return params, nil
+}
+
+// applyPassfiles looks up passwords that are still unset in the password
+// file, after defaults are applied so host, port and user are known.
+func (c *Config) applyPassfiles() error {
+	for _, p := range c.postgresConfigs() {
+		if p.Password != "" {
+			continue
+		}
+		password, err := p.lookupPassfile()
+		if err != nil {
+			return err
+		}
+		p.Password = password
+	}
+	return nil
+}
+
+// lookupPassfile returns the password for these settings from passfile,
+// PGPASSFILE or ~/.pgpass, or "" if there is none. Like libpq, files that
+// group or others can read are ignored.
+func (p PostgresConfig) lookupPassfile() (string, error) {
+	path := p.Passfile
+	if path == "" {
+		path = os.Getenv("PGPASSFILE")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && p.Passfile == "" {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading passfile: %w", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("reading passfile: %w", err)
+	}
+	defer f.Close()
+
+	// Sockets match "localhost", and the database defaults to the user
+	host := p.Host
+	if p.IsUnixSocket() {
+		host = "localhost"
+	}
+	database := p.Database
+	if database == "" {
+		database = p.User
+	}
+	want := []string{host, strconv.Itoa(p.Port), database, p.User}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := splitPassfileLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		if passfileMatch(fields[:4], want) {
+			return fields[4], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// splitPassfileLine splits a hostname:port:database:username:password
+// line, where \: and \\ escape a colon and a backslash.
+func splitPassfileLine(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// passfileMatch compares passfile fields with the connection, where "*"
+// matches anything.
+func passfileMatch(fields, want []string) bool {
+	for i, field := range fields {
+		if field != "*" && field != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,29 +1,54 @@
 package connection
 
 import (
+	"math/rand/v2"
 	"sync"
 	"time"
 )
 
+// Jitter strategies for reconnection backoff.
+const (
+	// JitterNone waits exactly initial * multiplier^n, capped at max.
+	JitterNone = "none"
+	// JitterFull waits a random duration between 0 and the exponential
+	// delay, spreading reconnects evenly across the window.
+	JitterFull = "full"
+	// JitterDecorrelated waits a random duration between initial and three
+	// times the previous delay, capped at max.
+	JitterDecorrelated = "decorrelated"
+)
+
 // backoff implements exponential backoff with jitter.
 type backoff struct {
 	initial    time.Duration
 	max        time.Duration
 	multiplier float64
-	current    time.Duration
+	jitter     string
+	current    time.Duration // un-jittered exponential delay
+	previous   time.Duration // last decorrelated delay
+	randN      func(n int64) int64
 	mu         sync.Mutex
 }
 
-// newBackoff creates a new backoff calculator.
+// newBackoff creates a new backoff calculator without jitter.
 func newBackoff(initial, max time.Duration, multiplier float64) *backoff {
 	return &backoff{
 		initial:    initial,
 		max:        max,
 		multiplier: multiplier,
+		jitter:     JitterNone,
 		current:    initial,
+		previous:   initial,
+		randN:      rand.Int64N,
 	}
 }
 
+// withJitter sets the jitter strategy.
+func (b *backoff) withJitter(jitter string) *backoff {
+	b.jitter = jitter
+	return b
+}
+
 // Next returns the next backoff duration and advances the state.
 func (b *backoff) Next() time.Duration {
 	b.mu.Lock()
@@ -34,7 +59,29 @@ func (b *backoff) Next() time.Duration {
 	if b.current > b.max {
 		b.current = b.max
 	}
-	return d
+
+	switch b.jitter {
+	case JitterFull:
+		return b.between(0, d)
+	case JitterDecorrelated:
+		upper := 3 * b.previous
+		if upper > b.max {
+			upper = b.max
+		}
+		b.previous = b.between(b.initial, upper)
+		return b.previous
+	default:
+		return d
+	}
+}
+
+// between returns a random duration in [lo, hi]. Must be called with b.mu
+// held.
+func (b *backoff) between(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(b.randN(int64(hi-lo)+1))
 }
 
 // Reset resets the backoff to initial state.
@@ -42,4 +89,5 @@ func (b *backoff) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.current = b.initial
+	b.previous = b.initial
 }
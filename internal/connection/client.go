@@ -3,23 +3,37 @@ package connection
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/identity"
 )
 
 // Client manages the WebSocket connection to the control plane.
+//
+// One goroutine reads (readLoop) and one writes data frames (writeLoop).
+// Senders only encode and queue messages, so a slow write never holds mu.
+// Control frames are written directly with WriteControl, which is safe to
+// call concurrently with the writer.
 type Client struct {
 	config   Config
 	conn     *websocket.Conn
-	mu       sync.RWMutex
+	mu       sync.RWMutex // guards conn and connection state, never held during I/O
 	closed   bool
 	closeCh  chan struct{}
 	commands chan Command
+	updates  chan ConfigUpdatePayload
 
 	// State from welcome message
 	serverID               string
@@ -27,6 +41,33 @@ type Client struct {
 	signingPublicKey       string
 	commandsEnabled        bool
 
+	// Negotiated during the handshake
+	protocolVersion int
+	capabilities    map[string]bool
+
+	// Last error message received after the handshake
+	serverErr *ServerError
+
+	// Set once the warning about dropped labeled series was logged
+	warnedUnlabeled atomic.Bool
+
+	// Liveness
+	lastReceive atomic.Int64 // unix nanoseconds
+	missedPongs atomic.Int32
+	rtt         atomic.Int64 // nanoseconds
+
+	// Write path
+	outbox     *outbox
+	writerStop chan struct{}
+	stopOnce   sync.Once
+
+	// Encoding and batching
+	stats      *TransportStats
+	binary     atomic.Bool
+	batchMu    sync.Mutex
+	pending    []Message
+	batchTimer *time.Timer
+
 	// Logging
 	logger *slog.Logger
 }
@@ -35,10 +76,13 @@ type Client struct {
 func NewClient(config Config) *Client {
 	config = config.WithDefaults()
 	return &Client{
-		config:   config,
-		closeCh:  make(chan struct{}),
-		commands: make(chan Command, 10),
-		logger:   slog.Default(),
+		config:     config,
+		closeCh:    make(chan struct{}),
+		writerStop: make(chan struct{}),
+		commands:   make(chan Command, 10),
+		updates:    make(chan ConfigUpdatePayload, 4),
+		stats:      &TransportStats{},
+		logger:     slog.Default(),
 	}
 }
 
@@ -56,46 +100,75 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 	c.mu.Unlock()
 
-	// Add token as query parameter
-	url := c.config.URL
-	if url[len(url)-1] != '?' {
-		url += "?"
+	c.logger.Debug("connecting to control plane", "url", c.config.URL, "auth_mode", c.config.AuthMode)
+	if c.config.AuthMode == AuthChallenge && c.config.Identity == nil {
+		return ErrIdentityRequired
 	}
-	url += "token=" + c.config.Token
-
-	c.logger.Debug("connecting to control plane", "url", c.config.URL)
 
-	// Dial with context
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
-	}
-
-	conn, resp, err := dialer.DialContext(ctx, url, http.Header{})
+	conn, err := c.dial(ctx)
 	if err != nil {
-		if resp != nil {
-			c.logger.Error("connection failed", "status", resp.StatusCode, "error", err)
-		}
-		return fmt.Errorf("dial: %w", err)
+		return err
 	}
 
+	out := newOutbox(c.config.SendQueueSize, c.stats)
 	c.mu.Lock()
 	c.conn = conn
+	c.outbox = out
 	c.mu.Unlock()
+	go c.writeLoop(conn, out)
 
 	// Send agent_hello
+	helloPayload := AgentHelloPayload{
+		AgentVersion:    c.config.AgentVersion,
+		Hostname:        c.config.Hostname,
+		OS:              c.config.OS,
+		Arch:            c.config.Arch,
+		PostgresVersion: c.config.PostgresVersion,
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    c.config.Capabilities,
+		Instances:       c.config.Instances,
+	}
+	if versionOf := c.config.PostgresVersionFunc; versionOf != nil {
+		helloPayload.Instances = append([]InstanceInfo(nil), c.config.Instances...)
+		for i := range helloPayload.Instances {
+			helloPayload.Instances[i].PostgresVersion = versionOf(helloPayload.Instances[i].ID)
+		}
+		first := ""
+		if len(helloPayload.Instances) > 0 {
+			first = helloPayload.Instances[0].ID
+		}
+		helloPayload.PostgresVersion = versionOf(first)
+	}
+
+	var nonce string
+	if c.config.AuthMode == AuthChallenge {
+		nonce, err = c.readChallenge(ctx)
+		if err != nil {
+			c.stopWriter()
+			conn.Close()
+			return fmt.Errorf("read auth challenge: %w", err)
+		}
+		helloPayload.ChallengeResponse = signChallenge(c.config.Identity, nonce)
+	}
+
+	if id := c.config.Identity; id != nil {
+		proof := &IdentityProof{
+			Algorithm: identity.Algorithm,
+			KeyID:     id.KeyID(),
+			PublicKey: id.PublicKey(),
+			Timestamp: time.Now().Unix(),
+		}
+		proof.Signature = id.Sign(helloSigningInput(helloPayload, proof.Timestamp, nonce))
+		helloPayload.Identity = proof
+	}
+
 	hello := Message{
-		Type: "agent_hello",
-		Payload: AgentHelloPayload{
-			Token:           c.config.Token,
-			AgentVersion:    c.config.AgentVersion,
-			Hostname:        c.config.Hostname,
-			OS:              c.config.OS,
-			Arch:            c.config.Arch,
-			PostgresVersion: c.config.PostgresVersion,
-		},
+		Type:    "agent_hello",
+		Payload: helloPayload,
 	}
 
-	if err := c.send(hello); err != nil {
+	if err := c.send(ctx, hello); err != nil {
+		c.stopWriter()
 		conn.Close()
 		return fmt.Errorf("send agent_hello: %w", err)
 	}
@@ -104,6 +177,7 @@ func (c *Client) Connect(ctx context.Context) error {
 
 	// Wait for welcome
 	if err := c.waitForWelcome(ctx); err != nil {
+		c.stopWriter()
 		conn.Close()
 		return fmt.Errorf("wait for welcome: %w", err)
 	}
@@ -112,16 +186,98 @@ func (c *Client) Connect(ctx context.Context) error {
 		"server_id", c.serverID,
 		"metrics_interval", c.metricsIntervalSeconds,
 		"commands_enabled", c.commandsEnabled,
+		"protocol_version", c.protocolVersion,
+		"capabilities", c.Capabilities(),
 	)
 
+	// Any frame, including control frames, proves the connection is alive
+	c.markReceived()
+	conn.SetPongHandler(func(appData string) error {
+		c.markReceived()
+		conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			c.recordPong(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+	conn.SetPingHandler(func(appData string) error {
+		c.markReceived()
+		conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+		return nil
+	})
+
 	// Start message reader
 	go c.readLoop()
 
 	return nil
 }
 
-// waitForWelcome waits for the welcome message from the server.
-func (c *Client) waitForWelcome(ctx context.Context) error {
+// dial opens the WebSocket connection. A rejected upgrade is returned as
+// a ServerError carrying the HTTP status.
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout:  10 * time.Second,
+		Proxy:             c.config.Proxy,
+		NetDialContext:    countingDialer(c.stats),
+		EnableCompression: !c.config.DisableCompression,
+	}
+	if c.config.TLSConfig != nil {
+		dialer.TLSClientConfig = c.config.TLSConfig.Clone()
+	}
+
+	// Never put the token in the URL, where proxies and load balancers log it
+	header := http.Header{}
+	if c.config.AuthMode != AuthChallenge {
+		header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, c.config.URL, header)
+	if err != nil {
+		if resp != nil {
+			c.logger.Error("connection failed", "status", resp.StatusCode, "error", err)
+			return nil, fmt.Errorf("dial: %w", &ServerError{
+				StatusCode: resp.StatusCode,
+				Message:    http.StatusText(resp.StatusCode),
+				RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			})
+		}
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	return conn, nil
+}
+
+// Probe checks that the control plane accepts the agent's connection
+// without starting a session. It completes the WebSocket upgrade, which
+// verifies the token in bearer mode, waits for the auth challenge in
+// challenge mode, then closes without sending agent_hello.
+func (c *Client) Probe(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if c.config.AuthMode == AuthChallenge {
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		if _, err := c.readChallenge(ctx); err != nil {
+			return fmt.Errorf("read auth challenge: %w", err)
+		}
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+	return nil
+}
+
+// readMessage reads a single message during the handshake, honouring the
+// context deadline.
+func (c *Client) readMessage(ctx context.Context) (Message, error) {
 	c.mu.RLock()
 	conn := c.conn
 	c.mu.RUnlock()
@@ -132,14 +288,74 @@ func (c *Client) waitForWelcome(ctx context.Context) error {
 	}
 	defer conn.SetReadDeadline(time.Time{})
 
-	_, data, err := conn.ReadMessage()
+	frameType, data, err := conn.ReadMessage()
+	if err != nil {
+		return Message{}, fmt.Errorf("read message: %w", err)
+	}
+
+	msg, err := decodeMessage(frameType, data)
+	if err != nil {
+		return Message{}, fmt.Errorf("unmarshal message: %w", err)
+	}
+
+	return msg, nil
+}
+
+// readChallenge waits for the server's auth_challenge and returns its nonce.
+func (c *Client) readChallenge(ctx context.Context) (string, error) {
+	msg, err := c.readMessage(ctx)
 	if err != nil {
-		return fmt.Errorf("read message: %w", err)
+		return "", err
+	}
+
+	switch msg.Type {
+	case "auth_challenge":
+		payloadBytes, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return "", fmt.Errorf("marshal payload: %w", err)
+		}
+
+		var challenge AuthChallengePayload
+		if err := json.Unmarshal(payloadBytes, &challenge); err != nil {
+			return "", fmt.Errorf("unmarshal challenge: %w", err)
+		}
+		if challenge.Nonce == "" {
+			return "", fmt.Errorf("auth challenge has no nonce")
+		}
+		return challenge.Nonce, nil
+
+	case "error":
+		return "", parseServerError(msg)
+
+	default:
+		return "", fmt.Errorf("unexpected message type: %s", msg.Type)
 	}
+}
 
-	var msg Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		return fmt.Errorf("unmarshal message: %w", err)
+// signChallenge answers a server nonce with the agent's identity key, so
+// only the agent holding the registered private key can authenticate.
+func signChallenge(id *identity.Identity, nonce string) *ChallengeResponse {
+	return &ChallengeResponse{
+		Algorithm: identity.Algorithm,
+		KeyID:     id.KeyID(),
+		PublicKey: id.PublicKey(),
+		Nonce:     nonce,
+		Signature: id.SignChallenge(nonce),
+	}
+}
+
+// helloSigningInput returns the bytes covered by an agent_hello identity
+// signature. The control plane rebuilds it from the received hello.
+func helloSigningInput(hello AgentHelloPayload, timestamp int64, nonce string) []byte {
+	return []byte(fmt.Sprintf("deploydb-agent-hello\n%s\n%s\n%d\n%d\n%s",
+		hello.Hostname, hello.AgentVersion, hello.ProtocolVersion, timestamp, nonce))
+}
+
+// waitForWelcome waits for the welcome message from the server.
+func (c *Client) waitForWelcome(ctx context.Context) error {
+	msg, err := c.readMessage(ctx)
+	if err != nil {
+		return err
 	}
 
 	switch msg.Type {
@@ -155,26 +371,98 @@ func (c *Client) waitForWelcome(ctx context.Context) error {
 			return fmt.Errorf("unmarshal welcome: %w", err)
 		}
 
+		version, capabilities, err := negotiate(c.config.Capabilities, welcome)
+		if err != nil {
+			return err
+		}
+
 		c.mu.Lock()
 		c.serverID = welcome.ServerID
 		c.metricsIntervalSeconds = welcome.MetricsIntervalSeconds
 		c.signingPublicKey = welcome.SigningPublicKey
 		c.commandsEnabled = welcome.CommandsEnabled
+		c.protocolVersion = version
+		c.capabilities = capabilities
 		c.mu.Unlock()
 
+		// Everything after the welcome uses the negotiated encoding
+		c.binary.Store(capabilities[CapMessagePack])
+
 		return nil
 
 	case "error":
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		var errPayload ErrorPayload
-		json.Unmarshal(payloadBytes, &errPayload)
-		return fmt.Errorf("server error: %s - %s", errPayload.Code, errPayload.Message)
+		serverErr := parseServerError(msg)
+		if serverErr.Code == "unsupported_protocol_version" {
+			return fmt.Errorf("%w: agent supports v%d-v%d: %s",
+				ErrIncompatibleProtocol, MinProtocolVersion, ProtocolVersion, serverErr.Message)
+		}
+		return serverErr
 
 	default:
 		return fmt.Errorf("unexpected message type: %s", msg.Type)
 	}
 }
 
+// parseServerError decodes an error message from the server.
+func parseServerError(msg Message) *ServerError {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var errPayload ErrorPayload
+	json.Unmarshal(payloadBytes, &errPayload)
+
+	return &ServerError{
+		Code:       errPayload.Code,
+		Message:    errPayload.Message,
+		RetryAfter: time.Duration(errPayload.RetryAfterSeconds) * time.Second,
+	}
+}
+
+// parseRetryAfter parses an HTTP Retry-After header, which is either a
+// number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// negotiate checks the protocol version chosen by the server and returns the
+// capabilities both sides support.
+func negotiate(local []string, welcome WelcomePayload) (int, map[string]bool, error) {
+	version := welcome.ProtocolVersion
+	if version == 0 {
+		// Server predates negotiation
+		version = 1
+	}
+
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, nil, fmt.Errorf("%w: server chose v%d, agent supports v%d-v%d",
+			ErrIncompatibleProtocol, version, MinProtocolVersion, ProtocolVersion)
+	}
+
+	offered := make(map[string]bool, len(local))
+	for _, name := range local {
+		offered[name] = true
+	}
+
+	agreed := make(map[string]bool)
+	for _, name := range welcome.Capabilities {
+		if offered[name] {
+			agreed[name] = true
+		}
+	}
+
+	return version, agreed, nil
+}
+
 // readLoop reads messages from the WebSocket.
 func (c *Client) readLoop() {
 	defer func() {
@@ -183,6 +471,7 @@ func (c *Client) readLoop() {
 			c.conn.Close()
 			c.conn = nil // Signal disconnection
 		}
+		c.stopWriter()
 		close(c.commands) // Close commands channel to signal readers
 		c.mu.Unlock()
 	}()
@@ -203,16 +492,25 @@ func (c *Client) readLoop() {
 			return
 		}
 
-		_, data, err := conn.ReadMessage()
+		// Control frames are handled inside ReadMessage; the ping and
+		// pong handlers extend this deadline themselves.
+		conn.SetReadDeadline(time.Now().Add(c.readTimeout()))
+		frameType, data, err := conn.ReadMessage()
 		if err != nil {
 			if !c.isClosed() {
-				c.logger.Error("read error", "error", err)
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					c.logger.Error("connection dead, nothing received", "timeout", c.readTimeout())
+				} else {
+					c.logger.Error("read error", "error", err)
+				}
 			}
 			return
 		}
+		c.markReceived()
 
-		var msg Message
-		if err := json.Unmarshal(data, &msg); err != nil {
+		msg, err := decodeMessage(frameType, data)
+		if err != nil {
 			c.logger.Warn("invalid message", "error", err)
 			continue
 		}
@@ -226,19 +524,64 @@ func (c *Client) handleMessage(msg Message) {
 	switch msg.Type {
 	case "command":
 		c.handleCommand(msg)
+	case "config_update":
+		if !c.HasCapability(CapConfigUpdate) {
+			c.logger.Warn("ignoring config_update, capability not negotiated")
+			return
+		}
+		c.handleConfigUpdate(msg)
+	case "batch":
+		c.handleBatch(msg)
+	case "ping":
+		// Answer without waiting, the reader never blocks on writes
+		if _, err := c.enqueue(Message{Type: "pong", Payload: msg.Payload}); err != nil {
+			c.logger.Warn("failed to queue pong", "error", err)
+		}
 	case "pong":
-		// Pong received, connection is alive
+		// RTT comes from the control frame pong, which is timed locally
+		c.recordPong(0)
 		c.logger.Debug("pong received")
 	case "error":
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		var errPayload ErrorPayload
-		json.Unmarshal(payloadBytes, &errPayload)
-		c.logger.Error("server error", "code", errPayload.Code, "message", errPayload.Message)
+		serverErr := parseServerError(msg)
+		c.logger.Error("server error", "code", serverErr.Code, "message", serverErr.Message,
+			"retry_after", serverErr.RetryAfter)
+
+		c.mu.Lock()
+		c.serverErr = serverErr
+		c.mu.Unlock()
+
+		// Nothing more will succeed on this connection
+		if serverErr.Permanent() {
+			c.closeConn()
+		}
 	default:
 		c.logger.Debug("unknown message type", "type", msg.Type)
 	}
 }
 
+// handleBatch processes each message of a batch frame in order.
+func (c *Client) handleBatch(msg Message) {
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		c.logger.Error("marshal batch payload", "error", err)
+		return
+	}
+
+	var batch BatchPayload
+	if err := json.Unmarshal(payloadBytes, &batch); err != nil {
+		c.logger.Error("unmarshal batch", "error", err)
+		return
+	}
+
+	for _, inner := range batch.Messages {
+		if inner.Type == "batch" {
+			c.logger.Warn("ignoring nested batch")
+			continue
+		}
+		c.handleMessage(inner)
+	}
+}
+
 // handleCommand processes a command message.
 func (c *Client) handleCommand(msg Message) {
 	payloadBytes, err := json.Marshal(msg.Payload)
@@ -275,6 +618,9 @@ func (c *Client) handleCommand(msg Message) {
 	if ts, ok := cmdPayload.SignedPayload["timestamp"].(float64); ok {
 		cmd.Timestamp = time.UnixMilli(int64(ts))
 	}
+	if instance, ok := cmdPayload.SignedPayload["instance_id"].(string); ok {
+		cmd.Instance = instance
+	}
 
 	select {
 	case c.commands <- cmd:
@@ -284,49 +630,334 @@ func (c *Client) handleCommand(msg Message) {
 	}
 }
 
-// send sends a message to the control plane.
-func (c *Client) send(msg Message) error {
+// handleConfigUpdate processes a config_update message.
+func (c *Client) handleConfigUpdate(msg Message) {
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		c.logger.Error("marshal config update payload", "error", err)
+		return
+	}
+
+	var update ConfigUpdatePayload
+	if err := json.Unmarshal(payloadBytes, &update); err != nil {
+		c.logger.Error("unmarshal config update", "error", err)
+		return
+	}
+
+	select {
+	case c.updates <- update:
+		c.logger.Info("config update received", "id", update.ID)
+	default:
+		c.logger.Warn("config update channel full, dropping update", "id", update.ID)
+	}
+}
+
+// send queues a message for the writer and waits until it has been
+// written, dropped or ctx is done.
+func (c *Client) send(ctx context.Context, msg Message) error {
+	item, err := c.enqueue(msg)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue encodes msg and queues it for the writer without waiting.
+func (c *Client) enqueue(msg Message) (*outgoing, error) {
 	c.mu.RLock()
-	conn := c.conn
+	conn, out := c.conn, c.outbox
 	c.mu.RUnlock()
 
 	if conn == nil {
-		return fmt.Errorf("not connected")
+		return nil, fmt.Errorf("not connected")
 	}
 
-	data, err := json.Marshal(msg)
+	frameType, data, payloadSize, err := encodeMessage(msg, c.binary.Load())
 	if err != nil {
-		return fmt.Errorf("marshal: %w", err)
+		return nil, err
 	}
 
-	c.mu.Lock()
-	err = conn.WriteMessage(websocket.TextMessage, data)
-	c.mu.Unlock()
+	messages := 1
+	if batch, ok := msg.Payload.(BatchPayload); ok {
+		messages = len(batch.Messages)
+	}
+
+	item := &outgoing{
+		frameType:   frameType,
+		data:        data,
+		payloadSize: payloadSize,
+		messages:    messages,
+		priority:    messagePriority(msg),
+		done:        make(chan error, 1),
+	}
+	if err := out.push(item); err != nil {
+		if errors.Is(err, ErrSendQueueFull) {
+			c.logger.Warn("send queue full, dropping message", "type", msg.Type)
+		}
+		return nil, err
+	}
+	return item, nil
+}
+
+// writeLoop is the only goroutine that writes data frames to conn. It
+// writes queued messages highest priority first, each with its own write
+// deadline, until the connection fails or the writer is stopped.
+func (c *Client) writeLoop(conn *websocket.Conn, out *outbox) {
+	for {
+		select {
+		case <-out.ready:
+		case <-c.writerStop:
+			out.close(ErrNotConnected)
+			return
+		}
+
+		for item := out.pop(); item != nil; item = out.pop() {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(item.frameType, item.data); err != nil {
+				item.done <- err
+				if !c.isClosed() {
+					c.logger.Error("write error", "error", err)
+				}
+				out.close(fmt.Errorf("write failed: %w", err))
+				// Ends the read loop as well
+				conn.Close()
+				return
+			}
 
-	return err
+			c.stats.framesSent.Add(1)
+			c.stats.messagesSent.Add(uint64(item.messages))
+			c.stats.payloadBytes.Add(uint64(item.payloadSize))
+			item.done <- nil
+		}
+	}
 }
 
-// Ping sends a ping message to keep the connection alive.
+// stopWriter stops the writer goroutine, failing anything still queued.
+func (c *Client) stopWriter() {
+	c.stopOnce.Do(func() { close(c.writerStop) })
+}
+
+// QueueLength returns the number of messages waiting to be written.
+func (c *Client) QueueLength() int {
+	c.mu.RLock()
+	out := c.outbox
+	c.mu.RUnlock()
+
+	if out == nil {
+		return 0
+	}
+	return out.len()
+}
+
+const (
+	// batchDelay is how long a queued message waits for others to share
+	// its frame.
+	batchDelay = 50 * time.Millisecond
+
+	// maxBatchSize flushes a batch early once this many messages are queued.
+	maxBatchSize = 32
+)
+
+// queue sends a small, latency-tolerant message. When the batch capability
+// was negotiated it is held briefly so that it can share a frame with
+// others; otherwise it is sent immediately. Queued messages are lost if the
+// connection drops before they are flushed.
+func (c *Client) queue(msg Message) error {
+	if !c.HasCapability(CapBatch) {
+		return c.send(context.Background(), msg)
+	}
+
+	c.batchMu.Lock()
+	c.pending = append(c.pending, msg)
+	if len(c.pending) >= maxBatchSize {
+		msgs := c.takePending()
+		c.batchMu.Unlock()
+		return c.sendBatch(msgs)
+	}
+	if c.batchTimer == nil {
+		c.batchTimer = time.AfterFunc(batchDelay, func() {
+			if err := c.flush(); err != nil {
+				c.logger.Warn("failed to send batch", "error", err)
+			}
+		})
+	}
+	c.batchMu.Unlock()
+
+	return nil
+}
+
+// flush sends any queued messages now.
+func (c *Client) flush() error {
+	c.batchMu.Lock()
+	msgs := c.takePending()
+	c.batchMu.Unlock()
+	return c.sendBatch(msgs)
+}
+
+// takePending empties the queue. The caller must hold batchMu.
+func (c *Client) takePending() []Message {
+	if c.batchTimer != nil {
+		c.batchTimer.Stop()
+		c.batchTimer = nil
+	}
+	msgs := c.pending
+	c.pending = nil
+	return msgs
+}
+
+// sendBatch sends msgs in a single frame, skipping the envelope for a
+// single message.
+func (c *Client) sendBatch(msgs []Message) error {
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return c.send(context.Background(), msgs[0])
+	default:
+		return c.send(context.Background(), Message{
+			Type:    "batch",
+			Payload: BatchPayload{Messages: msgs},
+		})
+	}
+}
+
+// Ping sends a WebSocket ping control frame and a JSON ping. It returns
+// ErrConnectionDead once MaxMissedPongs pings in a row went unanswered.
 func (c *Client) Ping(ctx context.Context) error {
+	if missed := int(c.missedPongs.Load()); missed >= c.config.MaxMissedPongs {
+		return fmt.Errorf("%w: %d pings unanswered", ErrConnectionDead, missed)
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	c.missedPongs.Add(1)
+
+	now := time.Now()
+	if err := conn.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(now.UnixNano(), 10)), now.Add(writeWait)); err != nil {
+		return fmt.Errorf("write ping: %w", err)
+	}
+
+	// Older servers only answer the JSON ping
 	msg := Message{
 		Type: "ping",
 		Payload: PingPayload{
-			Timestamp: time.Now().UnixMilli(),
+			Timestamp: now.UnixMilli(),
 		},
 	}
-	return c.send(msg)
+	return c.send(ctx, msg)
+}
+
+// writeWait bounds how long a control frame write may block.
+const writeWait = 10 * time.Second
+
+// readTimeout is how long the connection may stay silent before it is
+// considered dead.
+func (c *Client) readTimeout() time.Duration {
+	return c.config.PingInterval * time.Duration(c.config.MaxMissedPongs+1)
+}
+
+// markReceived records that something arrived from the server.
+func (c *Client) markReceived() {
+	c.lastReceive.Store(time.Now().UnixNano())
+}
+
+// recordPong resets the missed pong count and records the round trip.
+func (c *Client) recordPong(rtt time.Duration) {
+	c.missedPongs.Store(0)
+	if rtt > 0 {
+		c.rtt.Store(int64(rtt))
+	}
+}
+
+// LastReceive returns when anything was last received from the server.
+func (c *Client) LastReceive() time.Time {
+	nanos := c.lastReceive.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// RTT returns the most recently measured ping round-trip time, or 0 if no
+// pong has been received yet.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
 }
 
 // SendMetrics sends metrics to the control plane.
 func (c *Client) SendMetrics(ctx context.Context, metrics map[string]float64) error {
+	return c.SendMetricsPayload(ctx, MetricsPayload{
+		Timestamp: time.Now().UnixMilli(),
+		Metrics:   metrics,
+	})
+}
+
+// SendMetricsPayload sends a pre-built metrics batch, preserving its
+// timestamp and backfill flag. Unless the server negotiated
+// labeled_metrics, the first instance's series are sent without their
+// instance_id label and every other labeled series is left out, with a
+// warning the first time.
+func (c *Client) SendMetricsPayload(ctx context.Context, payload MetricsPayload) error {
+	if !c.HasCapability(CapLabeledMetrics) {
+		var primary string
+		if len(c.config.Instances) > 0 {
+			primary = c.config.Instances[0].ID
+		}
+		var dropped int
+		payload.Metrics, dropped = unlabeled(payload.Metrics, primary)
+		if dropped > 0 && !c.warnedUnlabeled.Swap(true) {
+			c.logger.Warn("control plane does not support labeled_metrics, sending only the first instance's PostgreSQL metrics",
+				"instance", primary, "dropped_series", dropped)
+		}
+	}
 	msg := Message{
-		Type: "metrics",
-		Payload: MetricsPayload{
-			Timestamp: time.Now().UnixMilli(),
-			Metrics:   metrics,
-		},
+		Type:    "metrics",
+		Payload: payload,
+	}
+	return c.send(ctx, msg)
+}
+
+// unlabeled returns metrics without labeled series, for servers that
+// would take name{label="value"} as a metric name. Series labeled only with
+// the primary instance keep their bare name. It also returns how many
+// series were left out.
+func unlabeled(metrics map[string]float64, primary string) (map[string]float64, int) {
+	labeled := false
+	for name := range metrics {
+		if strings.Contains(name, "{") {
+			labeled = true
+			break
+		}
+	}
+	if !labeled {
+		return metrics, 0
+	}
+
+	suffix := fmt.Sprintf("{instance_id=%q}", primary)
+	out := make(map[string]float64, len(metrics))
+	dropped := 0
+	for name, value := range metrics {
+		switch {
+		case !strings.Contains(name, "{"):
+			out[name] = value
+		case primary != "" && strings.HasSuffix(name, suffix):
+			out[strings.TrimSuffix(name, suffix)] = value
+		default:
+			dropped++
+		}
 	}
-	return c.send(msg)
+	return out, dropped
 }
 
 // SendCommandResult sends the result of a command execution.
@@ -335,7 +966,34 @@ func (c *Client) SendCommandResult(ctx context.Context, result CommandResultPayl
 		Type:    "command_result",
 		Payload: result,
 	}
-	return c.send(msg)
+	return c.send(ctx, msg)
+}
+
+// SendConfigAck acknowledges a config update.
+func (c *Client) SendConfigAck(ctx context.Context, ack ConfigAckPayload) error {
+	msg := Message{
+		Type:    "config_ack",
+		Payload: ack,
+	}
+	return c.queue(msg)
+}
+
+// SendCommandProgress reports progress of a running command. It is a no-op
+// unless the server negotiated the command_progress capability.
+func (c *Client) SendCommandProgress(ctx context.Context, progress CommandProgressPayload) error {
+	if !c.HasCapability(CapCommandProgress) {
+		return nil
+	}
+	msg := Message{
+		Type:    "command_progress",
+		Payload: progress,
+	}
+	return c.queue(msg)
+}
+
+// ConfigUpdates returns a channel of received config updates.
+func (c *Client) ConfigUpdates() <-chan ConfigUpdatePayload {
+	return c.updates
 }
 
 // Commands returns a channel of received commands.
@@ -343,6 +1001,11 @@ func (c *Client) Commands() <-chan Command {
 	return c.commands
 }
 
+// QueuedCommands returns the number of received commands not yet handled.
+func (c *Client) QueuedCommands() int {
+	return len(c.commands)
+}
+
 // ServerID returns the server ID assigned by the control plane.
 func (c *Client) ServerID() string {
 	c.mu.RLock()
@@ -371,8 +1034,85 @@ func (c *Client) CommandsEnabled() bool {
 	return c.commandsEnabled
 }
 
-// Close closes the connection.
+// ProtocolVersion returns the negotiated protocol version.
+func (c *Client) ProtocolVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.protocolVersion
+}
+
+// HasCapability returns whether both sides agreed on a capability.
+func (c *Client) HasCapability(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities[name]
+}
+
+// Capabilities returns the negotiated capabilities in sorted order.
+func (c *Client) Capabilities() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.capabilities))
+	for name := range c.capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setMetricsInterval overrides the metrics interval from the welcome message.
+func (c *Client) setMetricsInterval(seconds int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metricsIntervalSeconds = seconds
+}
+
+// setCommandsEnabled overrides whether command execution is enabled.
+func (c *Client) setCommandsEnabled(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commandsEnabled = enabled
+}
+
+// ServerError returns the last error the server sent on the established
+// connection, or nil.
+func (c *Client) ServerError() *ServerError {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.serverErr
+}
+
+// closeConn closes the underlying connection, which ends the read loop,
+// without closing the client.
+func (c *Client) closeConn() {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Stats returns the client's traffic counters.
+func (c *Client) Stats() *TransportStats {
+	return c.stats
+}
+
+// setStats makes the client count into stats, so that counters survive
+// reconnects. It must be called before Connect.
+func (c *Client) setStats(stats *TransportStats) {
+	c.stats = stats
+}
+
+// Close flushes queued messages and closes the connection.
 func (c *Client) Close() error {
+	if !c.isClosed() {
+		if err := c.flush(); err != nil {
+			c.logger.Debug("failed to flush queued messages", "error", err)
+		}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -382,6 +1122,7 @@ func (c *Client) Close() error {
 
 	c.closed = true
 	close(c.closeCh)
+	c.stopWriter()
 
 	if c.conn != nil {
 		return c.conn.Close()
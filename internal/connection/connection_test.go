@@ -2,7 +2,10 @@ package connection
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,59 +14,96 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/identity"
 )
 
 // Mock WebSocket server for testing
 type mockServer struct {
+	t           *testing.T
 	server      *httptest.Server
 	upgrader    websocket.Upgrader
 	connections []*websocket.Conn
 	mu          sync.Mutex
+	writeMu     sync.Mutex // held by handlers and SendToAll, the connections' writers
 	onConnect   func(conn *websocket.Conn)
 	onMessage   func(conn *websocket.Conn, msg Message)
+	onFrame     func(frameType int, msg Message)
+	lastRequest *http.Request
 }
 
 func newMockServer(t *testing.T) *mockServer {
 	ms := &mockServer{
+		t: t,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
 	}
 
-	ms.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := ms.upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			t.Logf("upgrade error: %v", err)
-			return
-		}
+	ms.server = httptest.NewServer(http.HandlerFunc(ms.handle))
+
+	return ms
+}
 
-		ms.mu.Lock()
-		ms.connections = append(ms.connections, conn)
-		ms.mu.Unlock()
+// newTLSMockServer starts a mock server over TLS. If clientCAs is set,
+// clients must present a certificate signed by one of them.
+func newTLSMockServer(t *testing.T, clientCAs *x509.CertPool) *mockServer {
+	ms := &mockServer{
+		t: t,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
 
-		if ms.onConnect != nil {
-			ms.onConnect(conn)
+	ms.server = httptest.NewUnstartedServer(http.HandlerFunc(ms.handle))
+	if clientCAs != nil {
+		ms.server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
 		}
+	}
+	ms.server.StartTLS()
 
-		// Read messages
-		for {
-			_, data, err := conn.ReadMessage()
-			if err != nil {
-				break
-			}
+	return ms
+}
 
-			var msg Message
-			if err := json.Unmarshal(data, &msg); err != nil {
-				continue
-			}
+func (ms *mockServer) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := ms.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		ms.t.Logf("upgrade error: %v", err)
+		return
+	}
 
-			if ms.onMessage != nil {
-				ms.onMessage(conn, msg)
-			}
+	ms.mu.Lock()
+	ms.connections = append(ms.connections, conn)
+	ms.lastRequest = r
+	ms.mu.Unlock()
+
+	if ms.onConnect != nil {
+		ms.onConnect(conn)
+	}
+
+	// Read messages
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
 		}
-	}))
 
-	return ms
+		msg, err := decodeMessage(frameType, data)
+		if err != nil {
+			continue
+		}
+
+		if ms.onFrame != nil {
+			ms.onFrame(frameType, msg)
+		}
+		if ms.onMessage != nil {
+			ms.writeMu.Lock()
+			ms.onMessage(conn, msg)
+			ms.writeMu.Unlock()
+		}
+	}
 }
 
 func (ms *mockServer) URL() string {
@@ -79,12 +119,21 @@ func (ms *mockServer) Close() {
 	ms.server.Close()
 }
 
+// LastRequest returns the most recent upgrade request.
+func (ms *mockServer) LastRequest() *http.Request {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.lastRequest
+}
+
 func (ms *mockServer) SendToAll(msg Message) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
+	ms.writeMu.Lock()
+	defer ms.writeMu.Unlock()
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
@@ -147,8 +196,13 @@ func TestClient_Connect(t *testing.T) {
 		t.Fatal("agent_hello was not received by server")
 	}
 
-	if receivedHello.Token != "ddb_testtoken123" {
-		t.Errorf("Token = %v, want %v", receivedHello.Token, "ddb_testtoken123")
+	// The token must travel in the Authorization header, not the URL
+	req := ms.LastRequest()
+	if got := req.Header.Get("Authorization"); got != "Bearer ddb_testtoken123" {
+		t.Errorf("Authorization = %v, want %v", got, "Bearer ddb_testtoken123")
+	}
+	if req.URL.Query().Get("token") != "" {
+		t.Errorf("token leaked into URL: %v", req.URL.String())
 	}
 
 	if receivedHello.AgentVersion != "1.0.0" {
@@ -233,6 +287,155 @@ func TestClient_Ping(t *testing.T) {
 	}
 }
 
+// welcomeOnHello answers agent_hello with a minimal welcome. If
+// ignorePings is set the server stops answering WebSocket pings.
+func welcomeOnHello(ignorePings bool) func(conn *websocket.Conn, msg Message) {
+	return func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		if ignorePings {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		data, _ := json.Marshal(Message{Type: "welcome", Payload: WelcomePayload{ServerID: "srv_123"}})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+}
+
+func TestClient_PingMeasuresRTT(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeOnHello(false)
+
+	client := NewClient(Config{URL: ms.URL(), Token: "test"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	if client.LastReceive().IsZero() {
+		t.Error("LastReceive() should be set after the welcome")
+	}
+
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.RTT() <= 0 {
+		t.Fatal("RTT() not measured after the server answered the ping")
+	}
+	if missed := client.missedPongs.Load(); missed != 0 {
+		t.Errorf("missed pongs = %d after pong, want 0", missed)
+	}
+}
+
+func TestClient_DeadAfterMissedPongs(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeOnHello(true)
+
+	client := NewClient(Config{
+		URL:            ms.URL(),
+		Token:          "test",
+		MaxMissedPongs: 2,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := client.Ping(ctx); err != nil {
+			t.Fatalf("Ping() #%d error = %v", i+1, err)
+		}
+	}
+
+	if err := client.Ping(ctx); !errors.Is(err, ErrConnectionDead) {
+		t.Errorf("Ping() after 2 unanswered pings error = %v, want ErrConnectionDead", err)
+	}
+}
+
+func TestClient_ReadDeadlineDetectsSilentServer(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeOnHello(true)
+
+	client := NewClient(Config{
+		URL:            ms.URL(),
+		Token:          "test",
+		PingInterval:   50 * time.Millisecond,
+		MaxMissedPongs: 1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.IsConnected() {
+		t.Error("client still connected after the server went silent past the read deadline")
+	}
+}
+
+func TestClient_PongsExtendReadDeadline(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeOnHello(true)
+
+	// Only control frames arrive after the welcome
+	ms.onConnect = func(conn *websocket.Conn) {
+		go func() {
+			ticker := time.NewTicker(20 * time.Millisecond)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	client := NewClient(Config{
+		URL:            ms.URL(),
+		Token:          "test",
+		PingInterval:   50 * time.Millisecond,
+		MaxMissedPongs: 1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	// Several read timeouts of 100ms
+	time.Sleep(500 * time.Millisecond)
+	if !client.IsConnected() {
+		t.Error("client disconnected although the server kept sending pongs")
+	}
+}
+
 func TestClient_SendMetrics(t *testing.T) {
 	ms := newMockServer(t)
 	defer ms.Close()
@@ -395,3 +598,376 @@ func TestBackoff(t *testing.T) {
 		t.Errorf("reset backoff = %v, want %v", d, 100*time.Millisecond)
 	}
 }
+
+func TestBackoff_Jitter(t *testing.T) {
+	initial, max := 100*time.Millisecond, 2*time.Second
+
+	t.Run("full", func(t *testing.T) {
+		b := newBackoff(initial, max, 2.0).withJitter(JitterFull)
+		ceiling := initial
+		for i := 0; i < 20; i++ {
+			d := b.Next()
+			if d < 0 || d > ceiling {
+				t.Fatalf("attempt %d: backoff %v outside [0, %v]", i, d, ceiling)
+			}
+			ceiling *= 2
+			if ceiling > max {
+				ceiling = max
+			}
+		}
+	})
+
+	t.Run("decorrelated", func(t *testing.T) {
+		b := newBackoff(initial, max, 2.0).withJitter(JitterDecorrelated)
+		prev := initial
+		for i := 0; i < 20; i++ {
+			d := b.Next()
+			upper := 3 * prev
+			if upper > max {
+				upper = max
+			}
+			if d < initial || d > upper {
+				t.Fatalf("attempt %d: backoff %v outside [%v, %v]", i, d, initial, upper)
+			}
+			prev = d
+		}
+	})
+
+	t.Run("spreads reconnects", func(t *testing.T) {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 50; i++ {
+			b := newBackoff(time.Second, time.Minute, 2.0).withJitter(JitterFull)
+			b.Next()
+			seen[b.Next()] = true
+		}
+		if len(seen) < 10 {
+			t.Errorf("only %d distinct delays across 50 agents", len(seen))
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestClient_ConnectReportsHTTPRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{URL: "ws" + strings.TrimPrefix(server.URL, "http"), Token: "test"})
+
+	err := client.Connect(context.Background())
+
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("Connect() error = %v, want *ServerError", err)
+	}
+	if serverErr.StatusCode != http.StatusServiceUnavailable || serverErr.RetryAfter != 42*time.Second {
+		t.Errorf("ServerError = %+v, want 503 with 42s retry", serverErr)
+	}
+	if errors.Is(err, ErrAuthRejected) {
+		t.Error("503 must not be treated as a permanent rejection")
+	}
+}
+
+func TestServerError_Permanent(t *testing.T) {
+	tests := []struct {
+		err              *ServerError
+		wantPermanent    bool
+		wantUnauthorized bool
+	}{
+		{&ServerError{Code: "token_revoked"}, true, true},
+		{&ServerError{Code: "invalid_token"}, true, true},
+		{&ServerError{StatusCode: http.StatusUnauthorized}, false, true},
+		{&ServerError{StatusCode: http.StatusForbidden}, false, true},
+		{&ServerError{Code: "unavailable"}, false, false},
+		{&ServerError{StatusCode: http.StatusTooManyRequests}, false, false},
+	}
+
+	for _, tt := range tests {
+		if got := errors.Is(tt.err, ErrAuthRejected); got != tt.wantPermanent {
+			t.Errorf("errors.Is(%v, ErrAuthRejected) = %v, want %v", tt.err, got, tt.wantPermanent)
+		}
+		if got := tt.err.Unauthorized(); got != tt.wantUnauthorized {
+			t.Errorf("%v Unauthorized() = %v, want %v", tt.err, got, tt.wantUnauthorized)
+		}
+	}
+}
+
+func TestClient_NegotiatesCapabilities(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	var receivedHello *AgentHelloPayload
+	var helloMu sync.Mutex
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			payload, _ := json.Marshal(msg.Payload)
+			var hello AgentHelloPayload
+			json.Unmarshal(payload, &hello)
+			helloMu.Lock()
+			receivedHello = &hello
+			helloMu.Unlock()
+
+			welcome := Message{
+				Type: "welcome",
+				Payload: WelcomePayload{
+					ServerID:               "srv_123",
+					MetricsIntervalSeconds: 30,
+					ProtocolVersion:        ProtocolVersion,
+					// compression was not offered by the agent
+					Capabilities: []string{CapBackfill, CapCompression},
+				},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	client := NewClient(Config{
+		URL:          ms.URL(),
+		Token:        "test",
+		AgentVersion: "1.0.0",
+		Capabilities: []string{CapBackfill, CapConfigUpdate},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	helloMu.Lock()
+	if receivedHello == nil {
+		t.Fatal("agent_hello was not received")
+	}
+	if receivedHello.ProtocolVersion != ProtocolVersion {
+		t.Errorf("hello protocol_version = %d, want %d", receivedHello.ProtocolVersion, ProtocolVersion)
+	}
+	if len(receivedHello.Capabilities) != 2 {
+		t.Errorf("hello capabilities = %v, want 2 entries", receivedHello.Capabilities)
+	}
+	helloMu.Unlock()
+
+	if client.ProtocolVersion() != ProtocolVersion {
+		t.Errorf("ProtocolVersion() = %d, want %d", client.ProtocolVersion(), ProtocolVersion)
+	}
+	if !client.HasCapability(CapBackfill) {
+		t.Error("backfill should be negotiated")
+	}
+	if client.HasCapability(CapConfigUpdate) {
+		t.Error("config_update was not offered by the server")
+	}
+	if client.HasCapability(CapCompression) {
+		t.Error("compression was not offered by the agent")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := []string{CapBackfill}
+
+	tests := []struct {
+		name    string
+		welcome WelcomePayload
+		want    int
+		wantErr bool
+	}{
+		{"legacy server", WelcomePayload{}, 1, false},
+		{"current version", WelcomePayload{ProtocolVersion: ProtocolVersion}, ProtocolVersion, false},
+		{"too new", WelcomePayload{ProtocolVersion: ProtocolVersion + 1}, 0, true},
+		{"too old", WelcomePayload{ProtocolVersion: -1}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, _, err := negotiate(local, tt.welcome)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrIncompatibleProtocol) {
+				t.Errorf("negotiate() error = %v, want ErrIncompatibleProtocol", err)
+			}
+			if version != tt.want {
+				t.Errorf("negotiate() version = %d, want %d", version, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_ConnectRejectsIncompatibleProtocol(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			welcome := Message{
+				Type: "welcome",
+				Payload: WelcomePayload{
+					ServerID:        "srv_123",
+					ProtocolVersion: ProtocolVersion + 1,
+				},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	client := NewClient(Config{
+		URL:          ms.URL(),
+		Token:        "test",
+		AgentVersion: "1.0.0",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Connect(ctx)
+	if !errors.Is(err, ErrIncompatibleProtocol) {
+		t.Fatalf("Connect() error = %v, want ErrIncompatibleProtocol", err)
+	}
+}
+
+func TestClient_ChallengeAuth(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	const token = "ddb_challenge_token"
+	const nonce = "server-nonce-123"
+
+	ms.onConnect = func(conn *websocket.Conn) {
+		challenge := Message{
+			Type:    "auth_challenge",
+			Payload: AuthChallengePayload{Nonce: nonce},
+		}
+		data, _ := json.Marshal(challenge)
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	helloCh := make(chan AgentHelloPayload, 1)
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			payload, _ := json.Marshal(msg.Payload)
+			var hello AgentHelloPayload
+			json.Unmarshal(payload, &hello)
+			helloCh <- hello
+
+			welcome := Message{
+				Type:    "welcome",
+				Payload: WelcomePayload{ServerID: "srv_123", MetricsIntervalSeconds: 30},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	agentIdentity, err := identity.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(Config{
+		URL:          ms.URL(),
+		Token:        token,
+		AuthMode:     AuthChallenge,
+		Identity:     agentIdentity,
+		AgentVersion: "1.0.0",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	if got := ms.LastRequest().Header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization header sent in challenge mode: %v", got)
+	}
+
+	hello := <-helloCh
+	response := hello.ChallengeResponse
+	if response == nil {
+		t.Fatal("agent_hello has no challenge_response")
+	}
+	if response.KeyID != agentIdentity.KeyID() || response.PublicKey != agentIdentity.PublicKey() {
+		t.Errorf("challenge_response key = %s, want the identity key %s", response.KeyID, agentIdentity.KeyID())
+	}
+	if response.Nonce != nonce {
+		t.Errorf("Nonce = %v, want %v", response.Nonce, nonce)
+	}
+	if !identity.Verify(response.PublicKey, identity.ChallengeMessage(nonce), response.Signature) {
+		t.Error("challenge_response signature does not verify against the identity key")
+	}
+
+	data, _ := json.Marshal(hello)
+	if strings.Contains(string(data), token) {
+		t.Errorf("agent_hello carries the token in challenge mode: %s", data)
+	}
+}
+
+func TestClient_ChallengeAuthNeedsIdentity(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	client := NewClient(Config{URL: ms.URL(), Token: "ddb_test", AuthMode: AuthChallenge})
+	if err := client.Connect(context.Background()); !errors.Is(err, ErrIdentityRequired) {
+		t.Fatalf("Connect() error = %v, want ErrIdentityRequired", err)
+	}
+	if ms.LastRequest() != nil {
+		t.Error("Connect() dialed without an identity")
+	}
+}
+
+func TestClient_ProbeSendsNoHello(t *testing.T) {
+	for _, mode := range []string{AuthBearer, AuthChallenge} {
+		t.Run(mode, func(t *testing.T) {
+			ms := newMockServer(t)
+			defer ms.Close()
+			if mode == AuthChallenge {
+				ms.onConnect = func(conn *websocket.Conn) {
+					data, _ := json.Marshal(Message{Type: "auth_challenge", Payload: AuthChallengePayload{Nonce: "n"}})
+					conn.WriteMessage(websocket.TextMessage, data)
+				}
+			}
+			frames := recordFrames(ms)
+
+			client := NewClient(Config{URL: ms.URL(), Token: "ddb_probe", AuthMode: mode})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := client.Probe(ctx); err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			if got := frames(); len(got) != 0 {
+				t.Errorf("Probe() sent %d messages, want none", len(got))
+			}
+			if ms.LastRequest() == nil {
+				t.Error("Probe() did not connect")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package connection
+
+import "time"
+
+// endpoints tracks the health of the control plane endpoints, which are
+// listed in priority order. It is only used by the manager's run loop.
+type endpoints struct {
+	urls     []string
+	cooldown time.Duration
+	failedAt []time.Time // zero while healthy
+	rejected []bool      // last attempt was refused for bad credentials
+	now      func() time.Time
+}
+
+func newEndpoints(urls []string, cooldown time.Duration) *endpoints {
+	return &endpoints{
+		urls:     urls,
+		cooldown: cooldown,
+		failedAt: make([]time.Time, len(urls)),
+		rejected: make([]bool, len(urls)),
+		now:      time.Now,
+	}
+}
+
+// healthy reports whether endpoint i has not failed within the cooldown.
+func (e *endpoints) healthy(i int) bool {
+	return e.failedAt[i].IsZero() || e.now().Sub(e.failedAt[i]) >= e.cooldown
+}
+
+// next returns the endpoint to try next: the highest priority healthy one
+// or, when every endpoint failed recently, the one that failed longest ago.
+func (e *endpoints) next() int {
+	oldest := 0
+	for i := range e.urls {
+		if e.healthy(i) {
+			return i
+		}
+		if e.failedAt[i].Before(e.failedAt[oldest]) {
+			oldest = i
+		}
+	}
+	return oldest
+}
+
+// allFailed reports whether every endpoint failed within the cooldown,
+// meaning a full round of attempts has failed and backoff applies.
+func (e *endpoints) allFailed() bool {
+	for i := range e.urls {
+		if e.healthy(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// preferred returns a healthy endpoint of higher priority than active, if
+// there is one to fail back to.
+func (e *endpoints) preferred(active int) (int, bool) {
+	for i := 0; i < active; i++ {
+		if e.healthy(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// allRejected reports whether the last attempt on every endpoint was
+// refused for bad credentials.
+func (e *endpoints) allRejected() bool {
+	for i := range e.urls {
+		if !e.rejected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *endpoints) markFailed(i int) {
+	e.failedAt[i] = e.now()
+	e.rejected[i] = false
+}
+
+// markRejected marks endpoint i as failed because it refused the agent's
+// credentials.
+func (e *endpoints) markRejected(i int) {
+	e.failedAt[i] = e.now()
+	e.rejected[i] = true
+}
+
+func (e *endpoints) markHealthy(i int) {
+	e.failedAt[i] = time.Time{}
+	e.rejected[i] = false
+}
@@ -0,0 +1,197 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEndpoints_Selection(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	e := newEndpoints([]string{"wss://primary", "wss://secondary", "wss://tertiary"}, time.Minute)
+	e.now = func() time.Time { return now }
+
+	if got := e.next(); got != 0 {
+		t.Fatalf("next() = %d, want the primary", got)
+	}
+
+	// Try the others in order as each fails
+	e.markFailed(0)
+	if got := e.next(); got != 1 {
+		t.Errorf("next() after primary failed = %d, want 1", got)
+	}
+	e.markFailed(1)
+	now = now.Add(time.Second)
+	e.markFailed(2)
+	if !e.allFailed() {
+		t.Error("allFailed() should be true once every endpoint failed")
+	}
+	// Round robin starting with the failure longest ago
+	if got := e.next(); got != 0 {
+		t.Errorf("next() with all failed = %d, want 0", got)
+	}
+
+	// Connected to the secondary, nothing to fail back to yet
+	e.markHealthy(1)
+	if _, ok := e.preferred(1); ok {
+		t.Error("preferred() should wait for the primary's cooldown")
+	}
+
+	now = now.Add(time.Minute)
+	if got, ok := e.preferred(1); !ok || got != 0 {
+		t.Errorf("preferred() after cooldown = %d, %v, want 0, true", got, ok)
+	}
+	if _, ok := e.preferred(0); ok {
+		t.Error("nothing is preferred over the primary")
+	}
+}
+
+func TestEndpoints_AllRejected(t *testing.T) {
+	e := newEndpoints([]string{"wss://primary", "wss://secondary"}, time.Minute)
+
+	e.markRejected(0)
+	e.markFailed(1)
+	if e.allRejected() {
+		t.Error("allRejected() with one endpoint unreachable, want false")
+	}
+	e.markRejected(1)
+	if !e.allRejected() {
+		t.Error("allRejected() after both refused the credentials, want true")
+	}
+	e.markHealthy(0)
+	if e.allRejected() {
+		t.Error("allRejected() after the primary accepted, want false")
+	}
+}
+
+func TestManager_FailsOverAndBack(t *testing.T) {
+	var primaryUp atomic.Bool
+
+	primary := newMockServer(t)
+	defer primary.Close()
+	primary.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		if !primaryUp.Load() {
+			data, _ := json.Marshal(Message{Type: "error", Payload: ErrorPayload{Code: "unavailable", Message: "region down"}})
+			conn.WriteMessage(websocket.TextMessage, data)
+			return
+		}
+		welcomeOnHello(false)(conn, msg)
+	}
+
+	secondary := newMockServer(t)
+	defer secondary.Close()
+	secondary.onMessage = welcomeOnHello(false)
+
+	manager := NewManager(Config{
+		Endpoints:        []string{primary.URL(), secondary.URL()},
+		Token:            "test",
+		InitialBackoff:   10 * time.Millisecond,
+		MaxBackoff:       10 * time.Millisecond,
+		FailbackCooldown: 200 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	waitForEndpoint := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) {
+			if manager.State() == StateConnected && manager.Endpoint() == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("endpoint = %q (state %s), want %q", manager.Endpoint(), manager.State(), want)
+	}
+
+	waitForEndpoint(secondary.URL())
+	if got := manager.SelfMetrics()["deploydb_agent_control_plane_endpoint_index"]; got != 1 {
+		t.Errorf("endpoint index = %v, want 1", got)
+	}
+
+	primaryUp.Store(true)
+	waitForEndpoint(primary.URL())
+	if got := manager.SelfMetrics()["deploydb_agent_control_plane_endpoint_index"]; got != 0 {
+		t.Errorf("endpoint index = %v, want 0", got)
+	}
+}
+
+func TestManager_RejectedByOneEndpointFailsOver(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer primary.Close()
+	primaryURL := "ws" + strings.TrimPrefix(primary.URL, "http")
+
+	secondary := newMockServer(t)
+	defer secondary.Close()
+	secondary.onMessage = welcomeOnHello(false)
+
+	manager := NewManager(Config{
+		Endpoints:      []string{primaryURL, secondary.URL()},
+		Token:          "test",
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for manager.State() != StateConnected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if manager.State() != StateConnected || manager.Endpoint() != secondary.URL() {
+		t.Fatalf("state = %s on %q, want connected to the secondary", manager.State(), manager.Endpoint())
+	}
+}
+
+func TestManager_RejectedByEveryEndpointIsFatal(t *testing.T) {
+	var urls []string
+	for range 2 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+		urls = append(urls, "ws"+strings.TrimPrefix(server.URL, "http"))
+	}
+
+	manager := NewManager(Config{
+		Endpoints:      urls,
+		Token:          "test",
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for manager.State() != StateFatal && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if manager.State() != StateFatal {
+		t.Fatalf("State() = %v, want fatal", manager.State())
+	}
+	if !errors.Is(manager.Err(), ErrAuthRejected) {
+		t.Errorf("Err() = %v, want ErrAuthRejected", manager.Err())
+	}
+}
@@ -0,0 +1,231 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestManager_RoutesCommandsByInstance(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	hello := make(chan AgentHelloPayload, 1)
+	results := make(chan CommandResultPayload, 2)
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		data, _ := json.Marshal(msg.Payload)
+		switch msg.Type {
+		case "agent_hello":
+			var payload AgentHelloPayload
+			json.Unmarshal(data, &payload)
+			hello <- payload
+			welcome, _ := json.Marshal(Message{Type: "welcome", Payload: WelcomePayload{
+				ServerID:        "srv_123",
+				CommandsEnabled: true,
+			}})
+			conn.WriteMessage(websocket.TextMessage, welcome)
+		case "command_result":
+			var result CommandResultPayload
+			json.Unmarshal(data, &result)
+			results <- result
+		}
+	}
+
+	manager := NewManager(Config{
+		URL:   ms.URL(),
+		Token: "test",
+		Instances: []InstanceInfo{
+			{ID: "main", Label: "PostgreSQL 16", PostgresVersion: "16.2"},
+			{ID: "pg15", PostgresVersion: "15.6"},
+		},
+	})
+
+	commands := make(chan Command, 1)
+	manager.OnCommand(func(cmd Command) { commands <- cmd })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	select {
+	case payload := <-hello:
+		if len(payload.Instances) != 2 || payload.Instances[1].ID != "pg15" || payload.Instances[1].PostgresVersion != "15.6" {
+			t.Errorf("agent_hello instances = %+v", payload.Instances)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for agent_hello")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for manager.State() != StateConnected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sendCommand := func(id, instance string) {
+		signed := map[string]interface{}{"server_id": "srv_123", "command": "analyze"}
+		if instance != "" {
+			signed["instance_id"] = instance
+		}
+		ms.SendToAll(Message{Type: "command", Payload: map[string]interface{}{
+			"id":             id,
+			"signed_payload": signed,
+			"signature":      "sig",
+		}})
+	}
+
+	sendCommand("cmd_1", "pg15")
+	select {
+	case cmd := <-commands:
+		if cmd.ID != "cmd_1" || cmd.Instance != "pg15" {
+			t.Errorf("command = %+v, want cmd_1 for pg15", cmd)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for command")
+	}
+
+	// Commands without a known instance never reach the handler
+	for _, tt := range []struct{ id, instance string }{{"cmd_2", "pg12"}, {"cmd_3", ""}} {
+		sendCommand(tt.id, tt.instance)
+		select {
+		case result := <-results:
+			if result.CommandID != tt.id || result.Status != "rejected" || result.InstanceID != tt.instance {
+				t.Errorf("command result = %+v, want %s rejected", result, tt.id)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s to be rejected", tt.id)
+		}
+	}
+	select {
+	case cmd := <-commands:
+		t.Errorf("handler received %s for an unknown instance", cmd.ID)
+	default:
+	}
+}
+
+func TestClient_LabeledMetricsNeedCapability(t *testing.T) {
+	metrics := map[string]float64{
+		"system_load_1m": 1,
+		`pg_connections_active{instance_id="main"}`:                   5,
+		`pg_connections_active{instance_id="pg15"}`:                   3,
+		`system_mount_total_bytes{instance_id="main",mountpoint="/"}`: 100,
+	}
+	instances := []InstanceInfo{{ID: "main"}, {ID: "pg15"}}
+
+	for _, tt := range []struct {
+		name         string
+		capabilities []string
+		instances    []InstanceInfo
+		want         map[string]float64
+		wantWarnings int
+	}{
+		{"negotiated", []string{CapLabeledMetrics}, instances, metrics, 0},
+		{"not negotiated", nil, nil, map[string]float64{"system_load_1m": 1}, 1},
+		{"not negotiated, first instance unlabeled", nil, instances,
+			map[string]float64{"system_load_1m": 1, "pg_connections_active": 5}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newMockServer(t)
+			defer ms.Close()
+			ms.onMessage = welcomeWithCapabilities(tt.capabilities...)
+			frames := recordFrames(ms)
+
+			var logs bytes.Buffer
+			client := NewClient(Config{URL: ms.URL(), Token: "test", Instances: tt.instances})
+			client.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := client.Connect(ctx); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer client.Close()
+
+			for range 2 {
+				if err := client.SendMetrics(context.Background(), metrics); err != nil {
+					t.Fatalf("SendMetrics() error = %v", err)
+				}
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for len(frames()) < 2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			got := frames()
+			if len(got) != 2 {
+				t.Fatalf("frames = %d, want 2", len(got))
+			}
+			data, _ := json.Marshal(got[0].msg.Payload)
+			var payload MetricsPayload
+			json.Unmarshal(data, &payload)
+			if !maps.Equal(payload.Metrics, tt.want) {
+				t.Errorf("sent metrics = %v, want %v", payload.Metrics, tt.want)
+			}
+
+			// Warned once per connection, not on every batch
+			if warnings := strings.Count(logs.String(), "does not support labeled_metrics"); warnings != tt.wantWarnings {
+				t.Errorf("logged %d warnings, want %d:\n%s", warnings, tt.wantWarnings, logs.String())
+			}
+		})
+	}
+}
+
+func TestClient_HelloResolvesPostgresVersion(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	hellos := make(chan AgentHelloPayload, 2)
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			data, _ := json.Marshal(msg.Payload)
+			var payload AgentHelloPayload
+			json.Unmarshal(data, &payload)
+			hellos <- payload
+		}
+		welcomeOnHello(false)(conn, msg)
+	}
+
+	// pg15 is down for the first handshake
+	var mu sync.Mutex
+	versions := map[string]string{"main": "16.2"}
+	config := Config{
+		URL:       ms.URL(),
+		Token:     "test",
+		Instances: []InstanceInfo{{ID: "main"}, {ID: "pg15"}},
+		PostgresVersionFunc: func(id string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			return versions[id]
+		},
+	}
+
+	connect := func() AgentHelloPayload {
+		t.Helper()
+		client := connectClient(t, config)
+		client.Close()
+		return <-hellos
+	}
+
+	hello := connect()
+	if hello.PostgresVersion != "16.2" || hello.Instances[1].PostgresVersion != "" {
+		t.Errorf("first agent_hello = %+v, want 16.2 and no version for pg15", hello)
+	}
+
+	mu.Lock()
+	versions["pg15"] = "15.6"
+	mu.Unlock()
+
+	hello = connect()
+	if hello.Instances[1].PostgresVersion != "15.6" {
+		t.Errorf("second agent_hello instances = %+v, want pg15 at 15.6", hello.Instances)
+	}
+	if config.Instances[1].PostgresVersion != "" {
+		t.Error("the configured instances must not be modified")
+	}
+}
@@ -73,7 +73,7 @@ func TestIntegration_AgentConnectsAndStaysConnected(t *testing.T) {
 	})
 
 	// Set up metrics handler
-	manager.SetMetricsHandler(func() map[string]float64 {
+	manager.SetMetricsHandler(func(ctx context.Context) map[string]float64 {
 		return map[string]float64{
 			"pg_connections_active": 5,
 			"pg_connections_idle":   10,
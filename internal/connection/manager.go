@@ -2,9 +2,16 @@ package connection
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/deploydb/agent/internal/spool"
+	"github.com/deploydb/agent/internal/tlsconfig"
 )
 
 // State represents the connection state.
@@ -14,6 +21,10 @@ const (
 	StateDisconnected State = iota
 	StateConnecting
 	StateConnected
+	// StateFatal means the control plane permanently rejected the agent
+	// (for example a revoked token). The manager does not reconnect until
+	// SetControlPlane provides new settings.
+	StateFatal
 )
 
 func (s State) String() string {
@@ -24,6 +35,8 @@ func (s State) String() string {
 		return "connecting"
 	case StateConnected:
 		return "connected"
+	case StateFatal:
+		return "fatal"
 	default:
 		return "unknown"
 	}
@@ -35,6 +48,17 @@ type StateChangeHandler func(state State)
 // CommandHandler is called when a command is received.
 type CommandHandler func(cmd Command)
 
+// ConfigUpdateHandler applies the agent-level parts of a config update (log
+// level, collectors) and returns the resulting settings. It must validate the
+// whole update before applying any of it, and return the unchanged settings
+// along with the error when rejecting. An update without agent-level fields
+// just reports the current settings.
+type ConfigUpdateHandler func(update ConfigUpdatePayload) (EffectiveConfig, error)
+
+// MetricsHandler collects one batch of metrics. The context carries a
+// deadline derived from the metrics interval.
+type MetricsHandler func(ctx context.Context) map[string]float64
+
 // Manager manages the connection lifecycle including reconnection.
 type Manager struct {
 	config         Config
@@ -43,24 +67,43 @@ type Manager struct {
 	logger         *slog.Logger
 	mu             sync.RWMutex
 	state          State
+	fatalErr       error
 	stopCh         chan struct{}
 	stoppedCh      chan struct{}
 	onStateChange  StateChangeHandler
 	onCommand      CommandHandler
+	onConfigUpdate ConfigUpdateHandler
 	pingTicker     *time.Ticker
-	metricsHandler func() map[string]float64
+	metricsHandler MetricsHandler
+	sinks          []MetricsSink
+	spool          *spool.Spool
+	scheduleCh     chan struct{}
+	batches        chan MetricsPayload
+	replaying      atomic.Bool
+	workers        sync.WaitGroup
+	stats          *TransportStats
+	endpoints      *endpoints
+	active         int       // priority index of the connected endpoint
+	endpoint       string    // URL of the connected endpoint
+	lastSent       time.Time // last metrics batch sent to the control plane
+	reconnectCh    chan struct{}
 }
 
 // NewManager creates a new connection manager.
 func NewManager(config Config) *Manager {
 	config = config.WithDefaults()
 	return &Manager{
-		config:    config,
-		backoff:   newBackoff(config.InitialBackoff, config.MaxBackoff, config.BackoffFactor),
-		logger:    slog.Default(),
-		state:     StateDisconnected,
-		stopCh:    make(chan struct{}),
-		stoppedCh: make(chan struct{}),
+		config:      config,
+		backoff:     newBackoff(config.InitialBackoff, config.MaxBackoff, config.BackoffFactor).withJitter(config.BackoffJitter),
+		logger:      slog.Default(),
+		state:       StateDisconnected,
+		stopCh:      make(chan struct{}),
+		stoppedCh:   make(chan struct{}),
+		scheduleCh:  make(chan struct{}, 1),
+		batches:     make(chan MetricsPayload, 16),
+		stats:       &TransportStats{},
+		endpoints:   newEndpoints(config.Endpoints, config.FailbackCooldown),
+		reconnectCh: make(chan struct{}, 1),
 	}
 }
 
@@ -79,15 +122,39 @@ func (m *Manager) OnCommand(handler CommandHandler) {
 	m.onCommand = handler
 }
 
+// OnConfigUpdate sets the handler for control plane config updates.
+func (m *Manager) OnConfigUpdate(handler ConfigUpdateHandler) {
+	m.onConfigUpdate = handler
+}
+
 // SetMetricsHandler sets the function that provides metrics to send.
-func (m *Manager) SetMetricsHandler(handler func() map[string]float64) {
+func (m *Manager) SetMetricsHandler(handler MetricsHandler) {
 	m.metricsHandler = handler
 }
 
+// AddSink registers an additional destination for collected metrics.
+// Sinks must be added before Start.
+func (m *Manager) AddSink(sink MetricsSink) {
+	m.sinks = append(m.sinks, sink)
+}
+
+// SetSpool sets the on-disk queue used to hold metrics collected while
+// disconnected. Spooled batches are replayed after the next welcome.
+func (m *Manager) SetSpool(s *spool.Spool) {
+	m.spool = s
+}
+
 // Start begins the connection manager loop.
 // It will connect and automatically reconnect on failures.
+// Metrics are collected on their own schedule regardless of connection state.
 func (m *Manager) Start(ctx context.Context) {
 	go m.run(ctx)
+
+	if m.metricsHandler != nil {
+		m.workers.Add(2)
+		go m.collectLoop(ctx)
+		go m.sendLoop(ctx)
+	}
 }
 
 // run is the main loop that manages connection and reconnection.
@@ -104,37 +171,85 @@ func (m *Manager) run(ctx context.Context) {
 			m.logger.Info("connection manager stopping (stop requested)")
 			m.cleanup()
 			return
+		case <-m.reconnectCh:
+			m.applyControlPlane()
 		default:
 		}
 
-		// Attempt to connect
+		// Attempt to connect, highest priority healthy endpoint first
 		m.setState(StateConnecting)
-		err := m.connect(ctx)
+		idx := m.endpoints.next()
+		err := m.connect(ctx, idx)
 		if err != nil {
-			m.logger.Error("connection failed", "error", err)
+			m.markFailed(idx, err)
+			if errors.Is(err, ErrAuthRejected) || errors.Is(err, ErrIdentityRequired) {
+				if !m.fail(ctx, err) {
+					return
+				}
+				continue
+			} else if m.endpoints.allRejected() {
+				if !m.fail(ctx, fmt.Errorf("%w: every endpoint refused the credentials: %w", ErrAuthRejected, err)) {
+					return
+				}
+				continue
+			} else if m.endpoints.rejected[idx] {
+				m.logger.Error("endpoint refused the credentials", "endpoint", m.endpoints.urls[idx], "error", err)
+			} else if errors.Is(err, ErrIncompatibleProtocol) {
+				m.logger.Error("control plane protocol is incompatible with this agent, upgrade the agent", "error", err)
+			} else if errors.Is(err, tlsconfig.ErrPinMismatch) {
+				m.logger.Error("refusing to connect: control plane certificate does not match the configured pins", "error", err)
+			} else {
+				m.logger.Error("connection failed", "endpoint", m.endpoints.urls[idx], "error", err)
+			}
 			m.setState(StateDisconnected)
 
-			// Wait before retry
-			backoffDuration := m.backoff.Next()
-			m.logger.Info("reconnecting", "backoff", backoffDuration)
+			// Fail over straight away; back off once every endpoint failed
+			var backoffDuration time.Duration
+			if m.endpoints.allFailed() {
+				backoffDuration = m.retryDelay(err)
+				m.logger.Info("reconnecting", "backoff", backoffDuration)
+			} else {
+				m.logger.Warn("failing over", "endpoint", m.endpoints.urls[m.endpoints.next()])
+			}
 
 			select {
 			case <-ctx.Done():
 				return
 			case <-m.stopCh:
 				return
+			case <-m.reconnectCh:
+				// New settings, retry with them right away
+				m.applyControlPlane()
+				continue
 			case <-time.After(backoffDuration):
 				continue
 			}
 		}
 
 		// Connected successfully
+		m.endpoints.markHealthy(idx)
 		m.setState(StateConnected)
 		m.backoff.Reset()
+		m.startReplay(ctx)
 
 		// Run connected loop
 		disconnectReason := m.runConnected(ctx)
 		m.logger.Info("disconnected", "reason", disconnectReason)
+
+		// Honour an error the server sent before closing the connection
+		pause := 100 * time.Millisecond
+		if serverErr := m.Client().ServerError(); serverErr != nil {
+			if serverErr.Permanent() {
+				if !m.fail(ctx, serverErr) {
+					return
+				}
+				continue
+			}
+			if serverErr.RetryAfter > pause {
+				pause = serverErr.RetryAfter
+				m.logger.Info("reconnecting", "retry_after", pause)
+			}
+		}
 		m.setState(StateDisconnected)
 
 		// Brief pause before reconnecting
@@ -143,32 +258,162 @@ func (m *Manager) run(ctx context.Context) {
 			return
 		case <-m.stopCh:
 			return
-		case <-time.After(100 * time.Millisecond):
+		case <-time.After(pause):
 		}
 	}
 }
 
-// connect attempts to establish a connection.
-func (m *Manager) connect(ctx context.Context) error {
-	// Create new client
-	client := NewClient(m.config)
-	client.SetLogger(m.logger)
+// SetControlPlane switches to new endpoints and token, e.g. after a config
+// reload. The current connection is closed so the next attempt uses them.
+func (m *Manager) SetControlPlane(endpoints []string, token string) {
+	m.mu.Lock()
+	m.config.Endpoints = endpoints
+	m.config.Token = token
+	m.mu.Unlock()
 
-	// Connect with timeout
-	connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	select {
+	case m.reconnectCh <- struct{}{}:
+	default:
+	}
+}
 
-	if err := client.Connect(connectCtx); err != nil {
+// applyControlPlane starts using the endpoints set by SetControlPlane.
+func (m *Manager) applyControlPlane() {
+	m.mu.Lock()
+	m.endpoints = newEndpoints(m.config.Endpoints, m.config.FailbackCooldown)
+	m.mu.Unlock()
+	m.backoff.Reset()
+}
+
+// SetMetricsInterval changes the local collection interval. An interval
+// sent by the control plane still takes precedence while connected.
+func (m *Manager) SetMetricsInterval(interval time.Duration) {
+	m.mu.Lock()
+	m.config.MetricsInterval = interval
+	m.mu.Unlock()
+
+	m.reschedule()
+}
+
+// retryDelay returns how long to wait after a failed connection attempt:
+// the jittered backoff, or the server's Retry-After if that is longer.
+func (m *Manager) retryDelay(err error) time.Duration {
+	d := m.backoff.Next()
+
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && serverErr.RetryAfter > d {
+		return serverErr.RetryAfter
+	}
+	return d
+}
+
+// markFailed records a failed attempt on endpoint idx, noting whether it
+// refused the credentials.
+func (m *Manager) markFailed(idx int, err error) {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && serverErr.Unauthorized() {
+		m.endpoints.markRejected(idx)
+		return
+	}
+	m.endpoints.markFailed(idx)
+}
+
+// fail stops reconnecting after a permanent rejection and waits for
+// SetControlPlane to provide new settings. It reports whether to reconnect
+// with them.
+func (m *Manager) fail(ctx context.Context, err error) bool {
+	m.logger.Error("control plane permanently rejected this agent, not reconnecting; fix the token and reload or restart the agent", "error", err)
+
+	m.mu.Lock()
+	if m.client != nil {
+		m.client.Close()
+		m.client = nil
+	}
+	m.fatalErr = err
+	m.mu.Unlock()
+
+	m.setState(StateFatal)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-m.stopCh:
+		return false
+	case <-m.reconnectCh:
+	}
+
+	m.mu.Lock()
+	m.fatalErr = nil
+	m.mu.Unlock()
+	m.applyControlPlane()
+	m.logger.Info("control plane settings changed, reconnecting")
+	return true
+}
+
+// Err returns the error that put the manager into StateFatal, or nil.
+func (m *Manager) Err() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fatalErr
+}
+
+// connect attempts to establish a connection to endpoint idx.
+func (m *Manager) connect(ctx context.Context, idx int) error {
+	client, err := m.dial(ctx, idx)
+	if err != nil {
 		return err
 	}
 
 	m.mu.Lock()
 	m.client = client
+	m.active = idx
+	m.endpoint = m.endpoints.urls[idx]
 	m.mu.Unlock()
 
 	return nil
 }
 
+// dial creates a client for endpoint idx and completes the handshake.
+func (m *Manager) dial(ctx context.Context, idx int) (*Client, error) {
+	m.mu.RLock()
+	config := m.config
+	m.mu.RUnlock()
+	config.URL = m.endpoints.urls[idx]
+
+	client := NewClient(config)
+	client.SetLogger(m.logger.With("endpoint", config.URL))
+	client.setStats(m.stats)
+
+	// Connect with timeout
+	connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if err := client.Connect(connectCtx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// probeFailback checks whether a higher priority endpoint is reachable
+// again by completing a handshake with it. The probe connection is closed
+// right away; the caller reconnects through the normal path.
+func (m *Manager) probeFailback(ctx context.Context) (int, bool) {
+	idx, ok := m.endpoints.preferred(m.active)
+	if !ok {
+		return 0, false
+	}
+
+	client, err := m.dial(ctx, idx)
+	if err != nil {
+		m.markFailed(idx, err)
+		m.logger.Info("preferred endpoint still unavailable", "endpoint", m.endpoints.urls[idx], "error", err)
+		return 0, false
+	}
+	client.Close()
+	m.endpoints.markHealthy(idx)
+	return idx, true
+}
+
 // runConnected handles the connected state: ping, metrics, commands.
 func (m *Manager) runConnected(ctx context.Context) string {
 	m.mu.RLock()
@@ -183,15 +428,28 @@ func (m *Manager) runConnected(ctx context.Context) string {
 	pingTicker := time.NewTicker(m.config.PingInterval)
 	defer pingTicker.Stop()
 
-	// Start metrics ticker if handler is set
-	var metricsTicker *time.Ticker
-	if m.metricsHandler != nil && client.MetricsInterval() > 0 {
-		metricsTicker = time.NewTicker(time.Duration(client.MetricsInterval()) * time.Second)
-		defer metricsTicker.Stop()
+	// Periodically try to move back to a higher priority endpoint
+	var failbackC <-chan time.Time
+	if m.active > 0 {
+		failbackTicker := time.NewTicker(m.config.FailbackCooldown)
+		defer failbackTicker.Stop()
+		failbackC = failbackTicker.C
 	}
 
 	for {
 		select {
+		case <-m.reconnectCh:
+			client.Close()
+			m.applyControlPlane()
+			return "control plane settings changed"
+
+		case <-failbackC:
+			if idx, ok := m.probeFailback(ctx); ok {
+				client.Close()
+				m.logger.Info("failing back", "endpoint", m.endpoints.urls[idx])
+				return "failing back to preferred endpoint"
+			}
+
 		case <-ctx.Done():
 			client.Close()
 			return "context cancelled"
@@ -202,44 +460,374 @@ func (m *Manager) runConnected(ctx context.Context) string {
 
 		case <-pingTicker.C:
 			if err := client.Ping(ctx); err != nil {
-				m.logger.Error("ping failed", "error", err)
 				client.Close()
+				if errors.Is(err, ErrConnectionDead) {
+					m.logger.Error("connection dead, reconnecting", "error", err,
+						"last_receive", client.LastReceive())
+					return "connection dead"
+				}
+				m.logger.Error("ping failed", "error", err)
 				return "ping failed"
 			}
-			m.logger.Debug("ping sent")
+			m.logger.Debug("ping sent", "rtt", client.RTT())
 
 		case cmd, ok := <-client.Commands():
 			if !ok {
 				return "commands channel closed"
 			}
+			if !client.CommandsEnabled() {
+				m.rejectCommand(ctx, client, cmd, "commands are disabled on this agent")
+				continue
+			}
+			if reason := m.checkInstance(cmd); reason != "" {
+				m.rejectCommand(ctx, client, cmd, reason)
+				continue
+			}
 			if m.onCommand != nil {
 				m.onCommand(cmd)
 			}
 
-		default:
-			// Check if still connected
-			if !client.IsConnected() {
-				return "connection lost"
-			}
+		case update := <-client.ConfigUpdates():
+			m.handleConfigUpdate(ctx, client, update)
+		}
+	}
+}
 
-			// Send metrics if ticker fired
-			if metricsTicker != nil {
-				select {
-				case <-metricsTicker.C:
-					if m.metricsHandler != nil {
-						metrics := m.metricsHandler()
-						if err := client.SendMetrics(ctx, metrics); err != nil {
-							m.logger.Error("send metrics failed", "error", err)
-						} else {
-							m.logger.Debug("metrics sent", "count", len(metrics))
-						}
-					}
-				default:
-				}
+// rejectCommand reports a command as rejected without executing it.
+func (m *Manager) rejectCommand(ctx context.Context, client *Client, cmd Command, reason string) {
+	m.logger.Warn("rejecting command", "id", cmd.ID, "command", cmd.Command, "instance", cmd.Instance, "reason", reason)
+
+	result := CommandResultPayload{
+		CommandID:  cmd.ID,
+		InstanceID: cmd.Instance,
+		Status:     "rejected",
+		Error:      reason,
+	}
+	if err := client.SendCommandResult(ctx, result); err != nil {
+		m.logger.Error("send command result failed", "error", err)
+	}
+}
+
+// checkInstance returns why a command cannot be routed to a PostgreSQL
+// instance, or "" if it can.
+func (m *Manager) checkInstance(cmd Command) string {
+	if len(m.config.Instances) == 0 {
+		if cmd.Instance != "" {
+			return fmt.Sprintf("unknown instance %q", cmd.Instance)
+		}
+		return ""
+	}
+	if cmd.Instance == "" {
+		return "instance_id is required, this agent monitors several instances"
+	}
+	for _, instance := range m.config.Instances {
+		if instance.ID == cmd.Instance {
+			return ""
+		}
+	}
+	return fmt.Sprintf("unknown instance %q", cmd.Instance)
+}
+
+// handleConfigUpdate applies a config update and acknowledges it with the
+// resulting effective configuration.
+func (m *Manager) handleConfigUpdate(ctx context.Context, client *Client, update ConfigUpdatePayload) {
+	ack := ConfigAckPayload{
+		UpdateID: update.ID,
+		Status:   "applied",
+	}
+
+	effective, err := m.applyConfigUpdate(client, update)
+	if err != nil {
+		m.logger.Warn("config update rejected", "id", update.ID, "error", err)
+		ack.Status = "rejected"
+		ack.Error = err.Error()
+	} else {
+		m.logger.Info("config update applied", "id", update.ID)
+	}
+
+	effective.MetricsIntervalSeconds = int(m.metricsInterval() / time.Second)
+	effective.CommandsEnabled = client.CommandsEnabled()
+	ack.Effective = effective
+
+	if err := client.SendConfigAck(ctx, ack); err != nil {
+		m.logger.Error("send config ack failed", "error", err)
+	}
+}
+
+// applyConfigUpdate validates and applies a config update. Nothing is
+// changed if any part of the update is invalid.
+func (m *Manager) applyConfigUpdate(client *Client, update ConfigUpdatePayload) (EffectiveConfig, error) {
+	var effective EffectiveConfig
+
+	if update.MetricsIntervalSeconds != 0 && update.MetricsIntervalSeconds < MinMetricsIntervalSeconds {
+		err := fmt.Errorf("metrics_interval_seconds must be at least %d", MinMetricsIntervalSeconds)
+		if m.onConfigUpdate != nil {
+			effective, _ = m.onConfigUpdate(ConfigUpdatePayload{ID: update.ID})
+		}
+		return effective, err
+	}
+
+	if m.onConfigUpdate != nil {
+		var err error
+		effective, err = m.onConfigUpdate(update)
+		if err != nil {
+			return effective, err
+		}
+	} else if update.LogLevel != "" || len(update.Collectors) > 0 {
+		return effective, fmt.Errorf("log level and collector updates are not supported")
+	}
+
+	if update.MetricsIntervalSeconds != 0 {
+		client.setMetricsInterval(update.MetricsIntervalSeconds)
+		m.reschedule()
+	}
+	if update.CommandsEnabled != nil {
+		client.setCommandsEnabled(*update.CommandsEnabled)
+	}
+
+	return effective, nil
+}
+
+// reschedule asks the collection loop to pick up a new interval.
+func (m *Manager) reschedule() {
+	select {
+	case m.scheduleCh <- struct{}{}:
+	default:
+	}
+}
+
+// collectLoop collects metrics on its own schedule, independent of the
+// connection state. Collections are aligned to wall-clock multiples of the
+// interval, using the control plane's interval while connected and the
+// local interval otherwise. Completed batches are handed to sendLoop.
+func (m *Manager) collectLoop(ctx context.Context) {
+	defer m.workers.Done()
+	defer close(m.batches)
+
+	interval := m.metricsInterval()
+	next := nextBoundary(time.Now(), interval)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-m.stopCh:
+			return
+
+		case <-m.scheduleCh:
+			if updated := m.metricsInterval(); updated != interval {
+				interval = updated
+				next = nextBoundary(time.Now(), interval)
+				timer.Reset(time.Until(next))
+				m.logger.Debug("metrics interval changed", "interval", interval)
 			}
 
-			// Small sleep to prevent tight loop
-			time.Sleep(10 * time.Millisecond)
+		case <-timer.C:
+			scheduled := next
+			m.collect(ctx, scheduled, interval)
+
+			// Skip boundaries missed by a slow collection
+			next = nextBoundary(time.Now(), interval)
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// sendLoop delivers batches produced by collectLoop until it exits.
+func (m *Manager) sendLoop(ctx context.Context) {
+	defer m.workers.Done()
+
+	for batch := range m.batches {
+		m.deliver(ctx, batch)
+	}
+}
+
+// nextBoundary returns the first multiple of interval after now.
+func nextBoundary(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
+
+// collectTimeout returns the deadline for one collection, leaving headroom
+// so a collection finishes before the next one is due.
+func collectTimeout(interval time.Duration) time.Duration {
+	return interval - interval/5
+}
+
+// metricsInterval returns the interval to collect metrics at.
+func (m *Manager) metricsInterval() time.Duration {
+	if client := m.connectedClient(); client != nil && client.MetricsInterval() > 0 {
+		return time.Duration(client.MetricsInterval()) * time.Second
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config.MetricsInterval
+}
+
+// collect runs the metrics handler for the given boundary and queues the
+// batch for sending.
+func (m *Manager) collect(ctx context.Context, at time.Time, interval time.Duration) {
+	collectCtx, cancel := context.WithTimeout(ctx, collectTimeout(interval))
+	defer cancel()
+
+	start := time.Now()
+	metrics := m.metricsHandler(collectCtx)
+	if metrics == nil {
+		return
+	}
+	m.logger.Debug("metrics collected", "count", len(metrics), "duration", time.Since(start))
+
+	batch := MetricsPayload{
+		Timestamp: at.UnixMilli(),
+		Metrics:   metrics,
+	}
+
+	select {
+	case m.batches <- batch:
+	default:
+		m.logger.Warn("metrics send queue full, spooling batch")
+		m.spoolMetrics(batch)
+	}
+}
+
+// deliver sends a batch to the control plane, spooling it for backfill if
+// that is not possible, and to every sink. Sinks get one interval to finish.
+func (m *Manager) deliver(ctx context.Context, batch MetricsPayload) {
+	if client := m.connectedClient(); client != nil {
+		if err := client.SendMetricsPayload(ctx, batch); err != nil {
+			m.logger.Error("send metrics failed", "error", err)
+			m.spoolMetrics(batch)
+		} else {
+			m.logger.Debug("metrics sent", "count", len(batch.Metrics))
+			m.mu.Lock()
+			m.lastSent = time.Now()
+			m.mu.Unlock()
+		}
+	} else {
+		m.spoolMetrics(batch)
+	}
+
+	if len(m.sinks) > 0 {
+		sinkCtx, cancel := context.WithTimeout(ctx, m.metricsInterval())
+		m.sendToSinks(sinkCtx, time.UnixMilli(batch.Timestamp), batch.Metrics)
+		cancel()
+	}
+}
+
+// spoolMetrics queues a batch for replay after reconnecting.
+func (m *Manager) spoolMetrics(payload MetricsPayload) {
+	if m.spool == nil {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		m.logger.Error("marshal spooled metrics", "error", err)
+		return
+	}
+
+	if err := m.spool.Push(data); err != nil {
+		m.logger.Error("spool metrics failed", "error", err)
+		return
+	}
+	m.logger.Debug("metrics spooled", "queued", m.spool.Len())
+}
+
+// startReplay starts replaying spooled metrics unless a replay is running.
+// Batches stay spooled if the control plane does not support backfill.
+func (m *Manager) startReplay(ctx context.Context) {
+	if m.spool == nil || m.spool.Len() == 0 {
+		return
+	}
+	if client := m.connectedClient(); client == nil || !client.HasCapability(CapBackfill) {
+		m.logger.Warn("control plane does not support backfill, keeping spooled metrics",
+			"queued", m.spool.Len())
+		return
+	}
+	if !m.replaying.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.workers.Add(1)
+	go m.replaySpool(ctx)
+}
+
+// replaySpool sends spooled batches oldest first with the backfill flag set,
+// waiting BackfillInterval between batches so replay does not flood the
+// connection. It stops when the spool is empty or the connection drops.
+func (m *Manager) replaySpool(ctx context.Context) {
+	defer m.workers.Done()
+	defer m.replaying.Store(false)
+
+	m.logger.Info("replaying spooled metrics", "batches", m.spool.Len())
+
+	sent := 0
+	for {
+		client := m.connectedClient()
+		if client == nil {
+			m.logger.Info("backfill interrupted", "sent", sent, "remaining", m.spool.Len())
+			return
+		}
+
+		entry, ok, err := m.spool.Oldest()
+		if err != nil {
+			m.logger.Error("read spool failed", "error", err)
+			return
+		}
+		if !ok {
+			m.logger.Info("backfill complete", "sent", sent)
+			return
+		}
+
+		var payload MetricsPayload
+		if err := json.Unmarshal(entry.Data, &payload); err != nil {
+			m.logger.Warn("discarding corrupt spool entry", "entry", entry.Name, "error", err)
+			m.spool.Remove(entry.Name)
+			continue
+		}
+		payload.Backfill = true
+
+		if err := client.SendMetricsPayload(ctx, payload); err != nil {
+			m.logger.Warn("backfill send failed", "error", err, "remaining", m.spool.Len())
+			return
+		}
+		if err := m.spool.Remove(entry.Name); err != nil {
+			m.logger.Error("remove spool entry failed", "error", err)
+			return
+		}
+		sent++
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.stopCh:
+			return
+		case <-time.After(m.config.BackfillInterval):
+		}
+	}
+}
+
+// connectedClient returns the current client if it is connected.
+func (m *Manager) connectedClient() *Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.state != StateConnected || m.client == nil || !m.client.IsConnected() {
+		return nil
+	}
+	return m.client
+}
+
+// sendToSinks delivers a metrics batch to every registered sink.
+func (m *Manager) sendToSinks(ctx context.Context, timestamp time.Time, metrics map[string]float64) {
+	for _, sink := range m.sinks {
+		if err := sink.SendMetrics(ctx, timestamp, metrics); err != nil {
+			m.logger.Error("sink send failed", "sink", sink.Name(), "error", err)
+		} else {
+			m.logger.Debug("metrics sent to sink", "sink", sink.Name(), "count", len(metrics))
 		}
 	}
 }
@@ -252,7 +840,15 @@ func (m *Manager) setState(state State) {
 	m.mu.Unlock()
 
 	if oldState != state {
-		m.logger.Info("state changed", "from", oldState, "to", state)
+		if state == StateConnected {
+			m.logger.Info("state changed", "from", oldState, "to", state, "endpoint", m.Endpoint())
+		} else {
+			m.logger.Info("state changed", "from", oldState, "to", state)
+		}
+
+		// Let the collection loop pick up the new interval
+		m.reschedule()
+
 		if m.onStateChange != nil {
 			m.onStateChange(state)
 		}
@@ -277,6 +873,7 @@ func (m *Manager) Client() *Client {
 func (m *Manager) Stop() {
 	close(m.stopCh)
 	<-m.stoppedCh
+	m.workers.Wait()
 }
 
 // cleanup closes the current client if any.
@@ -304,6 +901,74 @@ func (m *Manager) SendCommandResult(ctx context.Context, result CommandResultPay
 	return client.SendCommandResult(ctx, result)
 }
 
+// SendCommandProgress reports command progress through the current client.
+func (m *Manager) SendCommandProgress(ctx context.Context, progress CommandProgressPayload) error {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+
+	if client == nil {
+		return ErrNotConnected
+	}
+
+	return client.SendCommandProgress(ctx, progress)
+}
+
+// SelfMetrics returns metrics about the agent's own control plane
+// connection, for merging into collected metrics.
+func (m *Manager) SelfMetrics() map[string]float64 {
+	metrics := m.stats.Metrics()
+	metrics["deploydb_agent_control_plane_connected"] = 0
+
+	client := m.connectedClient()
+	if client == nil {
+		return metrics
+	}
+	metrics["deploydb_agent_control_plane_connected"] = 1
+	metrics["deploydb_agent_control_plane_endpoint_index"] = float64(m.activeIndex())
+	metrics["deploydb_agent_send_queue_length"] = float64(client.QueueLength())
+	if rtt := client.RTT(); rtt > 0 {
+		metrics["deploydb_agent_control_plane_rtt_seconds"] = rtt.Seconds()
+	}
+	if last := client.LastReceive(); !last.IsZero() {
+		metrics["deploydb_agent_control_plane_last_receive_age_seconds"] = time.Since(last).Seconds()
+	}
+	return metrics
+}
+
+// Endpoint returns the URL of the control plane endpoint in use, or of
+// the last one connected to.
+func (m *Manager) Endpoint() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.endpoint
+}
+
+// activeIndex returns the priority index of the endpoint in use, 0 being
+// the primary.
+func (m *Manager) activeIndex() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active
+}
+
+// LastMetricsSent returns when a metrics batch was last sent to the
+// control plane, or the zero time if none was.
+func (m *Manager) LastMetricsSent() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastSent
+}
+
+// QueuedCommands returns the number of received commands waiting to be
+// handled.
+func (m *Manager) QueuedCommands() int {
+	if client := m.connectedClient(); client != nil {
+		return client.QueuedCommands()
+	}
+	return 0
+}
+
 // ServerID returns the server ID from the current connection.
 func (m *Manager) ServerID() string {
 	m.mu.RLock()
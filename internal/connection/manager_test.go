@@ -3,11 +3,14 @@ package connection
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/spool"
 )
 
 func TestManager_ConnectAndReceiveCommand(t *testing.T) {
@@ -181,7 +184,7 @@ func TestManager_SendMetrics(t *testing.T) {
 		PingInterval: 5 * time.Second,
 	})
 
-	manager.SetMetricsHandler(func() map[string]float64 {
+	manager.SetMetricsHandler(func(ctx context.Context) map[string]float64 {
 		return map[string]float64{
 			"test_metric": 42.0,
 		}
@@ -202,6 +205,503 @@ func TestManager_SendMetrics(t *testing.T) {
 	if receivedMetrics["test_metric"] != float64(42) {
 		t.Errorf("test_metric = %v, want %v", receivedMetrics["test_metric"], 42)
 	}
+	if manager.LastMetricsSent().IsZero() {
+		t.Error("LastMetricsSent() should be set after sending metrics")
+	}
 
 	manager.Stop()
 }
+
+// recordingSink is a MetricsSink that records received batches.
+type recordingSink struct {
+	batches chan map[string]float64
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) SendMetrics(ctx context.Context, timestamp time.Time, metrics map[string]float64) error {
+	s.batches <- metrics
+	return nil
+}
+
+func TestManager_SendsMetricsToSinks(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			welcome := Message{
+				Type: "welcome",
+				Payload: WelcomePayload{
+					ServerID:               "srv_123",
+					MetricsIntervalSeconds: 1,
+				},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	manager := NewManager(Config{
+		URL:          ms.URL(),
+		Token:        "test",
+		AgentVersion: "1.0.0",
+		PingInterval: 5 * time.Second,
+	})
+
+	manager.SetMetricsHandler(func(ctx context.Context) map[string]float64 {
+		return map[string]float64{"test_metric": 42.0}
+	})
+
+	sink := &recordingSink{batches: make(chan map[string]float64, 10)}
+	manager.AddSink(sink)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	select {
+	case metrics := <-sink.batches:
+		if metrics["test_metric"] != 42.0 {
+			t.Errorf("test_metric = %v, want 42", metrics["test_metric"])
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for sink to receive metrics")
+	}
+}
+
+func TestManager_SpoolsWhileDisconnectedAndBackfills(t *testing.T) {
+	var attempts int32
+	backfilled := make(chan MetricsPayload, 100)
+
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		switch msg.Type {
+		case "agent_hello":
+			// Reject the first attempt so the agent starts out disconnected
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				reject := Message{
+					Type:    "error",
+					Payload: ErrorPayload{Code: "unavailable", Message: "try later"},
+				}
+				data, _ := json.Marshal(reject)
+				conn.WriteMessage(websocket.TextMessage, data)
+				return
+			}
+			welcome := Message{
+				Type: "welcome",
+				Payload: WelcomePayload{
+					ServerID:               "srv_123",
+					MetricsIntervalSeconds: 60,
+					ProtocolVersion:        ProtocolVersion,
+					Capabilities:           []string{CapBackfill},
+				},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+
+		case "metrics":
+			payload, _ := json.Marshal(msg.Payload)
+			var metrics MetricsPayload
+			json.Unmarshal(payload, &metrics)
+			if metrics.Backfill {
+				backfilled <- metrics
+			}
+		}
+	}
+
+	s, err := spool.Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("spool.Open() error = %v", err)
+	}
+
+	manager := NewManager(Config{
+		URL:              ms.URL(),
+		Token:            "test",
+		AgentVersion:     "1.0.0",
+		PingInterval:     5 * time.Second,
+		InitialBackoff:   500 * time.Millisecond,
+		MaxBackoff:       500 * time.Millisecond,
+		BackoffJitter:    JitterNone, // stay disconnected long enough to spool
+		MetricsInterval:  100 * time.Millisecond,
+		BackfillInterval: 10 * time.Millisecond,
+	})
+	manager.SetSpool(s)
+
+	var seq float64
+	manager.SetMetricsHandler(func(ctx context.Context) map[string]float64 {
+		seq++
+		return map[string]float64{"seq": seq}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	var received []MetricsPayload
+	timeout := time.After(3 * time.Second)
+	for len(received) < 2 {
+		select {
+		case p := <-backfilled:
+			received = append(received, p)
+		case <-timeout:
+			t.Fatalf("timeout waiting for backfill, got %d batches", len(received))
+		}
+	}
+
+	// Batches must be replayed oldest first
+	if received[0].Metrics["seq"] >= received[1].Metrics["seq"] {
+		t.Errorf("backfill out of order: %v then %v", received[0].Metrics["seq"], received[1].Metrics["seq"])
+	}
+	if received[0].Timestamp > received[1].Timestamp {
+		t.Errorf("backfill timestamps out of order: %d then %d", received[0].Timestamp, received[1].Timestamp)
+	}
+}
+
+func TestNextBoundary(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		now      time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{base.Add(7 * time.Second), 30 * time.Second, base.Add(30 * time.Second)},
+		{base.Add(30 * time.Second), 30 * time.Second, base.Add(60 * time.Second)},
+		{base.Add(59*time.Second + 999*time.Millisecond), time.Minute, base.Add(time.Minute)},
+	}
+
+	for _, tt := range tests {
+		if got := nextBoundary(tt.now, tt.interval); !got.Equal(tt.want) {
+			t.Errorf("nextBoundary(%v, %v) = %v, want %v", tt.now, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestManager_ConfigUpdate(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	acks := make(chan ConfigAckPayload, 2)
+	results := make(chan CommandResultPayload, 1)
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		switch msg.Type {
+		case "agent_hello":
+			welcome := Message{
+				Type: "welcome",
+				Payload: WelcomePayload{
+					ServerID:               "srv_123",
+					MetricsIntervalSeconds: 30,
+					CommandsEnabled:        true,
+					ProtocolVersion:        ProtocolVersion,
+					Capabilities:           []string{CapConfigUpdate},
+				},
+			}
+			data, _ := json.Marshal(welcome)
+			conn.WriteMessage(websocket.TextMessage, data)
+
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				disabled := false
+				updates := []ConfigUpdatePayload{
+					{ID: "upd_bad", MetricsIntervalSeconds: 1},
+					{ID: "upd_ok", MetricsIntervalSeconds: 15, LogLevel: "debug", CommandsEnabled: &disabled},
+				}
+				for _, u := range updates {
+					data, _ := json.Marshal(Message{Type: "config_update", Payload: u})
+					conn.WriteMessage(websocket.TextMessage, data)
+				}
+
+				time.Sleep(100 * time.Millisecond)
+				cmd := Message{
+					Type: "command",
+					Payload: map[string]interface{}{
+						"id":             "cmd_after_disable",
+						"signed_payload": map[string]interface{}{"command": "analyze"},
+						"signature":      "sig",
+					},
+				}
+				data, _ := json.Marshal(cmd)
+				conn.WriteMessage(websocket.TextMessage, data)
+			}()
+
+		case "config_ack":
+			payload, _ := json.Marshal(msg.Payload)
+			var ack ConfigAckPayload
+			json.Unmarshal(payload, &ack)
+			acks <- ack
+
+		case "command_result":
+			payload, _ := json.Marshal(msg.Payload)
+			var result CommandResultPayload
+			json.Unmarshal(payload, &result)
+			results <- result
+		}
+	}
+
+	manager := NewManager(Config{
+		URL:          ms.URL(),
+		Token:        "test",
+		AgentVersion: "1.0.0",
+		PingInterval: 5 * time.Second,
+	})
+
+	var gotLogLevel string
+	manager.OnConfigUpdate(func(update ConfigUpdatePayload) (EffectiveConfig, error) {
+		if update.LogLevel != "" {
+			gotLogLevel = update.LogLevel
+		}
+		return EffectiveConfig{LogLevel: gotLogLevel}, nil
+	})
+
+	commandCalled := make(chan struct{}, 1)
+	manager.OnCommand(func(cmd Command) {
+		commandCalled <- struct{}{}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	var got []ConfigAckPayload
+	for len(got) < 2 {
+		select {
+		case ack := <-acks:
+			got = append(got, ack)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for config acks, got %d", len(got))
+		}
+	}
+
+	if got[0].UpdateID != "upd_bad" || got[0].Status != "rejected" {
+		t.Errorf("first ack = %+v, want rejected upd_bad", got[0])
+	}
+	if got[0].Effective.MetricsIntervalSeconds != 30 {
+		t.Errorf("rejected update changed interval to %d", got[0].Effective.MetricsIntervalSeconds)
+	}
+
+	if got[1].UpdateID != "upd_ok" || got[1].Status != "applied" {
+		t.Errorf("second ack = %+v, want applied upd_ok", got[1])
+	}
+	if got[1].Effective.MetricsIntervalSeconds != 15 {
+		t.Errorf("effective interval = %d, want 15", got[1].Effective.MetricsIntervalSeconds)
+	}
+	if got[1].Effective.CommandsEnabled {
+		t.Error("effective commands_enabled should be false")
+	}
+	if got[1].Effective.LogLevel != "debug" {
+		t.Errorf("effective log level = %q, want debug", got[1].Effective.LogLevel)
+	}
+
+	// Commands must now be rejected without reaching the handler
+	select {
+	case result := <-results:
+		if result.CommandID != "cmd_after_disable" || result.Status != "rejected" {
+			t.Errorf("command result = %+v, want rejected", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for command rejection")
+	}
+
+	select {
+	case <-commandCalled:
+		t.Error("command handler called while commands are disabled")
+	default:
+	}
+}
+
+func TestManager_RevokedTokenIsFatal(t *testing.T) {
+	var attempts int32
+
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			atomic.AddInt32(&attempts, 1)
+			data, _ := json.Marshal(Message{
+				Type:    "error",
+				Payload: ErrorPayload{Code: "token_revoked", Message: "token was revoked"},
+			})
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	manager := NewManager(Config{
+		URL:            ms.URL(),
+		Token:          "revoked",
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for manager.State() != StateFatal && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if manager.State() != StateFatal {
+		t.Fatalf("State() = %v, want fatal", manager.State())
+	}
+	if !errors.Is(manager.Err(), ErrAuthRejected) {
+		t.Errorf("Err() = %v, want ErrAuthRejected", manager.Err())
+	}
+
+	// No further attempts once fatal
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("connection attempts = %d, want 1", n)
+	}
+}
+
+func TestManager_HonorsRetryAfter(t *testing.T) {
+	attemptTimes := make(chan time.Time, 10)
+
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		attemptTimes <- time.Now()
+		data, _ := json.Marshal(Message{
+			Type:    "error",
+			Payload: ErrorPayload{Code: "overloaded", Message: "busy", RetryAfterSeconds: 1},
+		})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	manager := NewManager(Config{
+		URL:            ms.URL(),
+		Token:          "test",
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	var first, second time.Time
+	select {
+	case first = <-attemptTimes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for first attempt")
+	}
+	select {
+	case second = <-attemptTimes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for second attempt")
+	}
+
+	if gap := second.Sub(first); gap < 900*time.Millisecond {
+		t.Errorf("reconnected after %v, want at least the 1s retry-after", gap)
+	}
+}
+
+func TestManager_SetControlPlaneReconnects(t *testing.T) {
+	first := newMockServer(t)
+	defer first.Close()
+	first.onMessage = welcomeOnHello(false)
+
+	second := newMockServer(t)
+	defer second.Close()
+	second.onMessage = welcomeOnHello(false)
+
+	manager := NewManager(Config{URL: first.URL(), Token: "old"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	waitFor := func(desc string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", desc)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("first connection", func() bool {
+		return manager.State() == StateConnected && manager.Endpoint() == first.URL()
+	})
+
+	manager.SetControlPlane([]string{second.URL()}, "new")
+
+	waitFor("reconnect to the new endpoint", func() bool {
+		return manager.State() == StateConnected && manager.Endpoint() == second.URL()
+	})
+	if got := second.LastRequest().Header.Get("Authorization"); got != "Bearer new" {
+		t.Errorf("Authorization = %q, want the new token", got)
+	}
+}
+
+func TestManager_SetControlPlaneRecoversFromFatal(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		if ms.LastRequest().Header.Get("Authorization") == "Bearer revoked" {
+			data, _ := json.Marshal(Message{
+				Type:    "error",
+				Payload: ErrorPayload{Code: "token_revoked", Message: "token was revoked"},
+			})
+			conn.WriteMessage(websocket.TextMessage, data)
+			return
+		}
+		welcomeOnHello(false)(conn, msg)
+	}
+
+	manager := NewManager(Config{
+		URL:            ms.URL(),
+		Token:          "revoked",
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.Start(ctx)
+	defer manager.Stop()
+
+	waitForState := func(want State) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for manager.State() != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := manager.State(); got != want {
+			t.Fatalf("State() = %v, want %v", got, want)
+		}
+	}
+
+	waitForState(StateFatal)
+
+	// A config reload with a working token
+	manager.SetControlPlane([]string{ms.URL()}, "fixed")
+
+	waitForState(StateConnected)
+	if err := manager.Err(); err != nil {
+		t.Errorf("Err() = %v after reconnecting, want nil", err)
+	}
+}
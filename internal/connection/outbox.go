@@ -0,0 +1,152 @@
+package connection
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSendQueueFull is returned when a message is dropped because the
+// outbound queue is full.
+var ErrSendQueueFull = errors.New("send queue full")
+
+// Outbound message priorities, highest first. When several messages are
+// waiting, the writer always sends the highest priority one next.
+const (
+	priorityControl  = iota // pings, pongs, acks and command results
+	priorityEvent           // progress updates and batches
+	priorityMetrics         // live metrics
+	priorityBackfill        // spooled metrics being replayed
+	numPriorities
+)
+
+// messagePriority returns the queue priority of an outbound message.
+func messagePriority(msg Message) int {
+	switch msg.Type {
+	case "metrics":
+		if payload, ok := msg.Payload.(MetricsPayload); ok && payload.Backfill {
+			return priorityBackfill
+		}
+		return priorityMetrics
+	case "command_progress", "batch":
+		return priorityEvent
+	default:
+		return priorityControl
+	}
+}
+
+// outgoing is an encoded message waiting for the writer.
+type outgoing struct {
+	frameType   int
+	data        []byte
+	payloadSize int
+	messages    int
+	priority    int
+	done        chan error // receives the write result; buffered
+}
+
+// outbox is a bounded priority queue of outgoing messages.
+//
+// When it is full, a new message evicts the oldest queued message of a
+// strictly lower priority. If there is none, the new message is rejected.
+// Either way the dropped message fails with ErrSendQueueFull and is counted.
+type outbox struct {
+	mu       sync.Mutex
+	queues   [numPriorities][]*outgoing
+	size     int
+	capacity int
+	closeErr error
+	ready    chan struct{}
+	stats    *TransportStats
+}
+
+func newOutbox(capacity int, stats *TransportStats) *outbox {
+	return &outbox{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+		stats:    stats,
+	}
+}
+
+// push queues item for the writer.
+func (o *outbox) push(item *outgoing) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closeErr != nil {
+		return o.closeErr
+	}
+
+	if o.size >= o.capacity {
+		victim := o.evictLocked(item.priority)
+		if victim == nil {
+			o.stats.sendDropped.Add(1)
+			return ErrSendQueueFull
+		}
+		victim.done <- ErrSendQueueFull
+		o.stats.sendDropped.Add(1)
+	}
+
+	o.queues[item.priority] = append(o.queues[item.priority], item)
+	o.size++
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// evictLocked removes the oldest message of the lowest priority that is
+// strictly below priority, or returns nil.
+func (o *outbox) evictLocked(priority int) *outgoing {
+	for p := numPriorities - 1; p > priority; p-- {
+		if len(o.queues[p]) > 0 {
+			victim := o.queues[p][0]
+			o.queues[p] = o.queues[p][1:]
+			o.size--
+			return victim
+		}
+	}
+	return nil
+}
+
+// pop removes the next message to write, or returns nil if none is queued.
+func (o *outbox) pop() *outgoing {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for p := range o.queues {
+		if len(o.queues[p]) > 0 {
+			item := o.queues[p][0]
+			o.queues[p] = o.queues[p][1:]
+			o.size--
+			return item
+		}
+	}
+	return nil
+}
+
+// len returns the number of queued messages.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.size
+}
+
+// close fails every queued message and all later pushes with err.
+func (o *outbox) close(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closeErr != nil {
+		return
+	}
+	o.closeErr = err
+	for p := range o.queues {
+		for _, item := range o.queues[p] {
+			item.done <- err
+		}
+		o.queues[p] = nil
+	}
+	o.size = 0
+}
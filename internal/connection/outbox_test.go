@@ -0,0 +1,121 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newItem(priority int) *outgoing {
+	return &outgoing{priority: priority, done: make(chan error, 1)}
+}
+
+func TestMessagePriority(t *testing.T) {
+	tests := []struct {
+		msg  Message
+		want int
+	}{
+		{Message{Type: "command_result"}, priorityControl},
+		{Message{Type: "ping"}, priorityControl},
+		{Message{Type: "pong"}, priorityControl},
+		{Message{Type: "command_progress"}, priorityEvent},
+		{Message{Type: "metrics", Payload: MetricsPayload{}}, priorityMetrics},
+		{Message{Type: "metrics", Payload: MetricsPayload{Backfill: true}}, priorityBackfill},
+	}
+
+	for _, tt := range tests {
+		if got := messagePriority(tt.msg); got != tt.want {
+			t.Errorf("messagePriority(%s) = %d, want %d", tt.msg.Type, got, tt.want)
+		}
+	}
+}
+
+func TestOutbox_PopsHighestPriorityFirst(t *testing.T) {
+	out := newOutbox(10, &TransportStats{})
+
+	backfill := newItem(priorityBackfill)
+	metrics := newItem(priorityMetrics)
+	result := newItem(priorityControl)
+	for _, item := range []*outgoing{backfill, metrics, result} {
+		if err := out.push(item); err != nil {
+			t.Fatalf("push() error = %v", err)
+		}
+	}
+
+	for _, want := range []*outgoing{result, metrics, backfill} {
+		if got := out.pop(); got != want {
+			t.Errorf("pop() priority = %d, want %d", got.priority, want.priority)
+		}
+	}
+	if out.pop() != nil {
+		t.Error("pop() on empty outbox should return nil")
+	}
+}
+
+func TestOutbox_DropPolicy(t *testing.T) {
+	stats := &TransportStats{}
+	out := newOutbox(2, stats)
+
+	oldBackfill := newItem(priorityBackfill)
+	newBackfill := newItem(priorityBackfill)
+	out.push(oldBackfill)
+	out.push(newBackfill)
+
+	// A command result evicts the oldest lower priority message
+	result := newItem(priorityControl)
+	if err := out.push(result); err != nil {
+		t.Fatalf("push(control) error = %v", err)
+	}
+	if err := <-oldBackfill.done; !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("evicted message error = %v, want ErrSendQueueFull", err)
+	}
+
+	// Nothing lower than backfill to evict, so it is rejected
+	if err := out.push(newItem(priorityBackfill)); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("push(backfill) error = %v, want ErrSendQueueFull", err)
+	}
+
+	if got := stats.Metrics()["deploydb_agent_send_dropped_total"]; got != 2 {
+		t.Errorf("dropped = %v, want 2", got)
+	}
+	if out.len() != 2 {
+		t.Errorf("len() = %d, want 2", out.len())
+	}
+
+	out.close(ErrNotConnected)
+	if err := <-newBackfill.done; !errors.Is(err, ErrNotConnected) {
+		t.Errorf("queued message error after close = %v, want ErrNotConnected", err)
+	}
+	if err := out.push(newItem(priorityControl)); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("push() after close error = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestClient_AnswersServerPing(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeWithCapabilities()
+	frames := recordFrames(ms)
+
+	client := connectClient(t, Config{URL: ms.URL(), Token: "test"})
+
+	ms.SendToAll(Message{Type: "ping", Payload: PingPayload{Timestamp: 42}})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(frames()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := frames()
+	if len(got) != 1 || got[0].msg.Type != "pong" || got[0].frameType != websocket.TextMessage {
+		t.Fatalf("frames = %+v, want one pong", got)
+	}
+
+	// Sends fail cleanly once the writer has stopped
+	client.Close()
+	if err := client.SendMetrics(context.Background(), map[string]float64{"pg_up": 1}); err == nil {
+		t.Error("SendMetrics() after Close should fail")
+	}
+}
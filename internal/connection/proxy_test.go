@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/proxy"
+	"github.com/deploydb/agent/internal/proxy/proxytest"
+)
+
+func TestClient_ConnectThroughProxy(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type == "agent_hello" {
+			data, _ := json.Marshal(Message{Type: "welcome", Payload: WelcomePayload{ServerID: "srv_123"}})
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}
+
+	connectProxy, err := proxytest.NewConnectProxy("agent", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connectProxy.Close()
+
+	socksProxy, err := proxytest.NewSOCKS5Proxy("agent", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksProxy.Close()
+
+	tests := []struct {
+		name       string
+		proxy      *proxytest.Server
+		noProxy    string
+		wantTunnel bool
+	}{
+		{"http connect", connectProxy, "", true},
+		{"socks5", socksProxy, "", true},
+		{"no_proxy bypass", connectProxy, "127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyFunc, err := proxy.Config{URL: tt.proxy.URL, NoProxy: tt.noProxy}.Func()
+			if err != nil {
+				t.Fatalf("Func() error = %v", err)
+			}
+
+			client := NewClient(Config{
+				URL:   ms.URL(),
+				Token: "ddb_testtoken123",
+				Proxy: proxyFunc,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			before := tt.proxy.Tunnels()
+			if err := client.Connect(ctx); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			client.Close()
+
+			if tunneled := tt.proxy.Tunnels() > before; tunneled != tt.wantTunnel {
+				t.Errorf("tunneled through proxy = %v, want %v", tunneled, tt.wantTunnel)
+			}
+		})
+	}
+}
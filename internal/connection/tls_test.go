@@ -0,0 +1,210 @@
+package connection
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/identity"
+	"github.com/deploydb/agent/internal/tlsconfig"
+)
+
+func TestClient_MutualTLSAndIdentity(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	ms := newTLSMockServer(t, clientCAs)
+	defer ms.Close()
+
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatalf("identity.Generate() error = %v", err)
+	}
+
+	helloCh := make(chan AgentHelloPayload, 1)
+	ms.onMessage = func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		payload, _ := json.Marshal(msg.Payload)
+		var hello AgentHelloPayload
+		json.Unmarshal(payload, &hello)
+		helloCh <- hello
+
+		data, _ := json.Marshal(Message{Type: "welcome", Payload: WelcomePayload{ServerID: "srv_123"}})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	// Trust only the test server's certificate
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ms.server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+
+	tlsConfig, err := tlsconfig.Build(tlsconfig.Options{
+		CAFile:   caFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Build() error = %v", err)
+	}
+
+	client := NewClient(Config{
+		URL:          ms.URL(),
+		Token:        "ddb_testtoken123",
+		AgentVersion: "1.0.0",
+		Hostname:     "test-host",
+		Identity:     id,
+		TLSConfig:    tlsConfig,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer client.Close()
+
+	if peers := ms.LastRequest().TLS.PeerCertificates; len(peers) == 0 || !peers[0].Equal(clientCert) {
+		t.Error("server did not receive the client certificate")
+	}
+
+	hello := <-helloCh
+	proof := hello.Identity
+	if proof == nil {
+		t.Fatal("agent_hello has no identity proof")
+	}
+	if proof.PublicKey != id.PublicKey() || proof.KeyID != id.KeyID() {
+		t.Errorf("identity proof is for key %s, want %s", proof.KeyID, id.KeyID())
+	}
+	if !identity.Verify(proof.PublicKey, helloSigningInput(hello, proof.Timestamp, ""), proof.Signature) {
+		t.Error("agent_hello identity signature does not verify")
+	}
+}
+
+func TestClient_TLSWithoutClientCertRejected(t *testing.T) {
+	clientCert, _, _ := writeClientCert(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	ms := newTLSMockServer(t, clientCAs)
+	defer ms.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ms.server.Certificate())
+
+	client := NewClient(Config{
+		URL:       ms.URL(),
+		Token:     "ddb_testtoken123",
+		TLSConfig: &tls.Config{RootCAs: roots},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err == nil {
+		client.Close()
+		t.Fatal("Connect() should fail when the server requires a client certificate")
+	}
+}
+
+// writeClientCert creates a self-signed client certificate and returns it
+// with the paths of its PEM files.
+func writeClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deploydb-agent-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	return cert, certFile, keyFile
+}
+
+func TestClient_PinMismatchRefused(t *testing.T) {
+	ms := newTLSMockServer(t, nil)
+	defer ms.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ms.server.Certificate().Raw}), 0644)
+
+	// A pin for some other key; the server's certificate is otherwise trusted
+	otherCert, _, _ := writeClientCert(t)
+	tlsConfig, err := tlsconfig.Build(tlsconfig.Options{
+		CAFile: caFile,
+		Pins:   []string{tlsconfig.SPKIPin(otherCert)},
+	})
+	if err != nil {
+		t.Fatalf("tlsconfig.Build() error = %v", err)
+	}
+
+	client := NewClient(Config{
+		URL:       ms.URL(),
+		Token:     "ddb_testtoken123",
+		TLSConfig: tlsConfig,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if !errors.Is(err, tlsconfig.ErrPinMismatch) {
+		t.Fatalf("Connect() error = %v, want ErrPinMismatch", err)
+	}
+	if ms.LastRequest() != nil {
+		t.Error("agent reached the server despite the pin mismatch")
+	}
+}
@@ -0,0 +1,112 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/deploydb/agent/internal/msgpack"
+)
+
+// TransportStats counts traffic on control plane connections. Payload
+// bytes are the JSON size of sent messages; wire bytes are what actually
+// crossed the socket after encoding, compression and TLS.
+type TransportStats struct {
+	framesSent    atomic.Uint64
+	messagesSent  atomic.Uint64
+	payloadBytes  atomic.Uint64
+	wireBytesSent atomic.Uint64
+	wireBytesRecv atomic.Uint64
+	sendDropped   atomic.Uint64
+}
+
+// Metrics returns the counters as self-metrics.
+func (s *TransportStats) Metrics() map[string]float64 {
+	return map[string]float64{
+		"deploydb_agent_sent_frames_total":         float64(s.framesSent.Load()),
+		"deploydb_agent_sent_messages_total":       float64(s.messagesSent.Load()),
+		"deploydb_agent_sent_payload_bytes_total":  float64(s.payloadBytes.Load()),
+		"deploydb_agent_sent_wire_bytes_total":     float64(s.wireBytesSent.Load()),
+		"deploydb_agent_received_wire_bytes_total": float64(s.wireBytesRecv.Load()),
+		"deploydb_agent_send_dropped_total":        float64(s.sendDropped.Load()),
+	}
+}
+
+// countingConn counts bytes read from and written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	stats *TransportStats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stats.wireBytesRecv.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.wireBytesSent.Add(uint64(n))
+	return n, err
+}
+
+// countingDialer returns a dial function whose connections update stats.
+func countingDialer(stats *TransportStats) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, stats: stats}, nil
+	}
+}
+
+// encodeMessage serializes msg as a JSON text frame, or as a binary
+// MessagePack frame once that encoding has been negotiated.
+func encodeMessage(msg Message, binary bool) (frameType int, data []byte, jsonSize int, err error) {
+	data, err = json.Marshal(msg)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("marshal: %w", err)
+	}
+	if !binary {
+		return websocket.TextMessage, data, len(data), nil
+	}
+
+	// Go through the generic JSON form so struct tags apply unchanged
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return 0, nil, 0, fmt.Errorf("marshal: %w", err)
+	}
+	packed, err := msgpack.Marshal(generic)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("marshal: %w", err)
+	}
+	return websocket.BinaryMessage, packed, len(data), nil
+}
+
+// decodeMessage parses a received frame of either encoding.
+func decodeMessage(frameType int, data []byte) (Message, error) {
+	if frameType == websocket.BinaryMessage {
+		generic, err := msgpack.Unmarshal(data)
+		if err != nil {
+			return Message{}, err
+		}
+		if data, err = json.Marshal(generic); err != nil {
+			return Message{}, err
+		}
+	}
+
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
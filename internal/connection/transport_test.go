@@ -0,0 +1,255 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// welcomeWithCapabilities answers agent_hello with a welcome that agrees to
+// the given capabilities.
+func welcomeWithCapabilities(capabilities ...string) func(conn *websocket.Conn, msg Message) {
+	return func(conn *websocket.Conn, msg Message) {
+		if msg.Type != "agent_hello" {
+			return
+		}
+		data, _ := json.Marshal(Message{Type: "welcome", Payload: WelcomePayload{
+			ServerID:        "srv_123",
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    capabilities,
+		}})
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+}
+
+// frame is a message as received by the mock server.
+type frame struct {
+	frameType int
+	msg       Message
+}
+
+// recordFrames collects frames received by ms after the handshake.
+func recordFrames(ms *mockServer) func() []frame {
+	var mu sync.Mutex
+	var frames []frame
+	ms.onFrame = func(frameType int, msg Message) {
+		if msg.Type == "agent_hello" {
+			return
+		}
+		mu.Lock()
+		frames = append(frames, frame{frameType, msg})
+		mu.Unlock()
+	}
+	return func() []frame {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]frame(nil), frames...)
+	}
+}
+
+func connectClient(t *testing.T, config Config) *Client {
+	t.Helper()
+
+	client := NewClient(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestEncodeMessage_RoundTrip(t *testing.T) {
+	msg := Message{
+		Type: "metrics",
+		Payload: MetricsPayload{
+			Timestamp: 1700000000123,
+			Metrics:   map[string]float64{"pg_connections_active": 12, "pg_cache_hit_ratio": 0.97},
+		},
+	}
+
+	for _, binary := range []bool{false, true} {
+		frameType, data, jsonSize, err := encodeMessage(msg, binary)
+		if err != nil {
+			t.Fatalf("encodeMessage(binary=%v) error = %v", binary, err)
+		}
+
+		wantType := websocket.TextMessage
+		if binary {
+			wantType = websocket.BinaryMessage
+			if len(data) >= jsonSize {
+				t.Errorf("binary size = %d, want less than JSON size %d", len(data), jsonSize)
+			}
+		}
+		if frameType != wantType {
+			t.Errorf("frame type = %d, want %d", frameType, wantType)
+		}
+
+		decoded, err := decodeMessage(frameType, data)
+		if err != nil {
+			t.Fatalf("decodeMessage(binary=%v) error = %v", binary, err)
+		}
+		payload, _ := decoded.Payload.(map[string]interface{})
+		metrics, _ := payload["metrics"].(map[string]interface{})
+		if decoded.Type != "metrics" || metrics["pg_connections_active"] != 12.0 || metrics["pg_cache_hit_ratio"] != 0.97 {
+			t.Errorf("decoded = %+v", decoded)
+		}
+		if payload["timestamp"] != 1700000000123.0 {
+			t.Errorf("timestamp = %v", payload["timestamp"])
+		}
+	}
+}
+
+func TestClient_MessagePackEncoding(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeWithCapabilities(CapMessagePack, CapConfigUpdate)
+	frames := recordFrames(ms)
+
+	client := connectClient(t, Config{URL: ms.URL(), Token: "test"})
+
+	if err := client.SendMetrics(context.Background(), map[string]float64{"pg_up": 1}); err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(frames()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := frames()
+	if len(got) != 1 || got[0].msg.Type != "metrics" {
+		t.Fatalf("frames = %+v, want one metrics frame", got)
+	}
+	if got[0].frameType != websocket.BinaryMessage {
+		t.Errorf("frame type = %d, want binary", got[0].frameType)
+	}
+
+	// The server's frames are binary too
+	_, data, _, err := encodeMessage(Message{Type: "config_update", Payload: ConfigUpdatePayload{ID: "upd_1"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms.mu.Lock()
+	ms.connections[0].WriteMessage(websocket.BinaryMessage, data)
+	ms.mu.Unlock()
+
+	select {
+	case update := <-client.ConfigUpdates():
+		if update.ID != "upd_1" {
+			t.Errorf("update ID = %q, want upd_1", update.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("binary config_update was not received")
+	}
+}
+
+func TestClient_BatchesQueuedMessages(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeWithCapabilities(CapBatch, CapConfigUpdate)
+	frames := recordFrames(ms)
+
+	client := connectClient(t, Config{URL: ms.URL(), Token: "test"})
+
+	ctx := context.Background()
+	client.SendConfigAck(ctx, ConfigAckPayload{UpdateID: "upd_1", Status: "applied"})
+	client.SendConfigAck(ctx, ConfigAckPayload{UpdateID: "upd_2", Status: "applied"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(frames()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := frames()
+	if len(got) != 1 || got[0].msg.Type != "batch" {
+		t.Fatalf("frames = %+v, want one batch frame", got)
+	}
+	payload, _ := got[0].msg.Payload.(map[string]interface{})
+	if messages, _ := payload["messages"].([]interface{}); len(messages) != 2 {
+		t.Errorf("batch messages = %v, want 2", payload["messages"])
+	}
+
+	stats := client.Stats().Metrics()
+	// agent_hello plus the two acks, in two frames
+	if stats["deploydb_agent_sent_messages_total"] != 3 || stats["deploydb_agent_sent_frames_total"] != 2 {
+		t.Errorf("stats = %v", stats)
+	}
+
+	// Batches from the server are unpacked in order
+	ms.SendToAll(Message{Type: "batch", Payload: BatchPayload{Messages: []Message{
+		{Type: "config_update", Payload: ConfigUpdatePayload{ID: "upd_3"}},
+		{Type: "config_update", Payload: ConfigUpdatePayload{ID: "upd_4"}},
+	}}})
+	for _, want := range []string{"upd_3", "upd_4"} {
+		select {
+		case update := <-client.ConfigUpdates():
+			if update.ID != want {
+				t.Errorf("update ID = %q, want %q", update.ID, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s was not received", want)
+		}
+	}
+}
+
+func TestClient_CloseFlushesQueue(t *testing.T) {
+	ms := newMockServer(t)
+	defer ms.Close()
+	ms.onMessage = welcomeWithCapabilities(CapBatch)
+	frames := recordFrames(ms)
+
+	client := connectClient(t, Config{URL: ms.URL(), Token: "test"})
+	client.SendConfigAck(context.Background(), ConfigAckPayload{UpdateID: "upd_1", Status: "applied"})
+	client.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(frames()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := frames(); len(got) != 1 || got[0].msg.Type != "config_ack" {
+		t.Errorf("frames = %+v, want the queued config_ack", got)
+	}
+}
+
+func TestClient_NegotiatesCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		disable bool
+	}{
+		{"enabled", false},
+		{"disabled", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := newMockServer(t)
+			defer ms.Close()
+			ms.upgrader.EnableCompression = true
+			ms.onMessage = welcomeWithCapabilities()
+
+			client := connectClient(t, Config{URL: ms.URL(), Token: "test", DisableCompression: tt.disable})
+			if err := client.SendMetrics(context.Background(), map[string]float64{"pg_up": 1}); err != nil {
+				t.Fatalf("SendMetrics() error = %v", err)
+			}
+
+			offered := strings.Contains(ms.LastRequest().Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+			if offered == tt.disable {
+				t.Errorf("permessage-deflate offered = %v, want %v", offered, !tt.disable)
+			}
+
+			stats := client.Stats().Metrics()
+			if stats["deploydb_agent_sent_wire_bytes_total"] == 0 || stats["deploydb_agent_received_wire_bytes_total"] == 0 {
+				t.Errorf("wire bytes not counted: %v", stats)
+			}
+			if stats["deploydb_agent_sent_payload_bytes_total"] == 0 {
+				t.Errorf("payload bytes not counted: %v", stats)
+			}
+		})
+	}
+}
@@ -2,38 +2,137 @@
 package connection
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"time"
+
+	"github.com/deploydb/agent/internal/identity"
 )
 
 // Errors
 var (
-	ErrNotConnected = errors.New("not connected")
-	ErrClosed       = errors.New("client is closed")
+	ErrNotConnected         = errors.New("not connected")
+	ErrClosed               = errors.New("client is closed")
+	ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+	ErrConnectionDead       = errors.New("connection dead")
+	ErrAuthRejected         = errors.New("authentication permanently rejected")
+	ErrIdentityRequired     = errors.New("challenge auth needs an identity key")
+)
+
+// Protocol versions understood by this agent. Servers that predate
+// negotiation omit protocol_version and are treated as version 1.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Capabilities that can be negotiated in agent_hello and welcome.
+const (
+	CapLabeledMetrics  = "labeled_metrics"
+	CapCommandProgress = "command_progress"
+	CapCompression     = "compression"
+	CapConfigUpdate    = "config_update"
+	CapBackfill        = "backfill"
+	// CapMessagePack switches both sides to binary MessagePack frames
+	// after the welcome message.
+	CapMessagePack = "msgpack"
+	// CapBatch allows several small messages in one "batch" frame.
+	CapBatch = "batch"
 )
 
+// DefaultCapabilities lists the capabilities this agent implements.
+var DefaultCapabilities = []string{
+	CapLabeledMetrics,
+	CapConfigUpdate,
+	CapBackfill,
+	CapCommandProgress,
+	CapMessagePack,
+	CapBatch,
+}
+
 // Message is the envelope for all WebSocket messages.
 type Message struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
 }
 
+// Authentication modes for the control plane connection.
+const (
+	// AuthBearer sends the token in the Authorization header.
+	AuthBearer = "bearer"
+	// AuthChallenge never sends the token; the agent signs a server nonce
+	// with its identity key, registered with the control plane during
+	// bootstrap, instead.
+	AuthChallenge = "challenge"
+)
+
+// AuthChallengePayload is sent by the server before agent_hello when using
+// challenge-response authentication.
+type AuthChallengePayload struct {
+	Nonce string `json:"nonce"`
+}
+
+// ChallengeResponse answers an auth challenge. Signature is the identity
+// key's signature of identity.ChallengeMessage(Nonce); KeyID and PublicKey
+// identify the registered key.
+type ChallengeResponse struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Nonce     string `json:"nonce"`
+	Signature string `json:"signature"`
+}
+
 // AgentHelloPayload is sent when the agent first connects.
 type AgentHelloPayload struct {
-	Token           string `json:"token"`
-	AgentVersion    string `json:"agent_version"`
-	Hostname        string `json:"hostname"`
-	OS              string `json:"os"`
-	Arch            string `json:"arch"`
+	AgentVersion    string   `json:"agent_version"`
+	Hostname        string   `json:"hostname"`
+	OS              string   `json:"os"`
+	Arch            string   `json:"arch"`
+	PostgresVersion string   `json:"postgres_version,omitempty"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Capabilities    []string `json:"capabilities"`
+
+	// Instances lists the PostgreSQL clusters when the agent monitors
+	// several. Their metrics are labeled instance_id.
+	Instances []InstanceInfo `json:"instances,omitempty"`
+
+	ChallengeResponse *ChallengeResponse `json:"challenge_response,omitempty"`
+	Identity          *IdentityProof     `json:"identity,omitempty"`
+}
+
+// InstanceInfo describes one monitored PostgreSQL instance.
+type InstanceInfo struct {
+	ID              string `json:"id"`
+	Label           string `json:"label,omitempty"`
 	PostgresVersion string `json:"postgres_version,omitempty"`
 }
 
+// IdentityProof binds agent_hello to the agent's registered identity key.
+// Signature covers helloSigningInput, so it cannot be replayed with a
+// different hostname, timestamp or challenge nonce.
+type IdentityProof struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
 // WelcomePayload is received after successful authentication.
+// ProtocolVersion is the version the server chose for this connection and
+// Capabilities the subset of the agent's capabilities it supports.
 type WelcomePayload struct {
-	ServerID               string `json:"server_id"`
-	MetricsIntervalSeconds int    `json:"metrics_interval_seconds"`
-	SigningPublicKey       string `json:"signing_public_key,omitempty"`
-	CommandsEnabled        bool   `json:"commands_enabled"`
+	ServerID               string   `json:"server_id"`
+	MetricsIntervalSeconds int      `json:"metrics_interval_seconds"`
+	SigningPublicKey       string   `json:"signing_public_key,omitempty"`
+	CommandsEnabled        bool     `json:"commands_enabled"`
+	ProtocolVersion        int      `json:"protocol_version,omitempty"`
+	Capabilities           []string `json:"capabilities,omitempty"`
 }
 
 // ErrorPayload is received when the server rejects the connection.
@@ -43,10 +142,68 @@ type ErrorPayload struct {
 	RetryAfterSeconds int    `json:"retry_after_seconds,omitempty"`
 }
 
+// permanentErrorCodes are server error codes that retrying cannot fix.
+var permanentErrorCodes = map[string]bool{
+	"invalid_token":  true,
+	"token_revoked":  true,
+	"server_deleted": true,
+	"unauthorized":   true,
+}
+
+// ServerError is a rejection by the control plane, either an error message
+// or an HTTP status during the WebSocket handshake. It unwraps to
+// ErrAuthRejected when retrying cannot succeed.
+type ServerError struct {
+	Code       string
+	Message    string
+	StatusCode int           // HTTP status, if rejected during the handshake
+	RetryAfter time.Duration // how long the server asked us to wait
+}
+
+func (e *ServerError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("server returned HTTP %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("server error: %s - %s", e.Code, e.Message)
+}
+
+// Permanent reports whether the agent should stop reconnecting. Only an
+// explicit error code is permanent; an HTTP status may come from a single
+// misconfigured endpoint or proxy.
+func (e *ServerError) Permanent() bool {
+	return permanentErrorCodes[e.Code]
+}
+
+// Unauthorized reports whether the server rejected the agent's credentials,
+// by error code or by HTTP status.
+func (e *ServerError) Unauthorized() bool {
+	return e.Permanent() ||
+		e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+func (e *ServerError) Unwrap() error {
+	if e.Permanent() {
+		return ErrAuthRejected
+	}
+	return nil
+}
+
 // MetricsPayload is sent periodically with collected metrics.
+// Backfill is set for batches collected while disconnected and replayed later.
 type MetricsPayload struct {
 	Timestamp int64              `json:"timestamp"`
 	Metrics   map[string]float64 `json:"metrics"`
+	Backfill  bool               `json:"backfill,omitempty"`
+}
+
+// MetricsSink receives every collected metrics batch in addition to the
+// control plane. Sinks deliver metrics on their own transport and must not
+// depend on the WebSocket connection.
+type MetricsSink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	// SendMetrics delivers one batch collected at the given time.
+	SendMetrics(ctx context.Context, timestamp time.Time, metrics map[string]float64) error
 }
 
 // PingPayload is sent as a keepalive.
@@ -68,42 +225,140 @@ type CommandPayload struct {
 
 // Command represents a command received from the control plane.
 type Command struct {
-	ID            string
-	ServerID      string
-	Command       string
-	Params        map[string]interface{}
-	Nonce         string
-	Timestamp     time.Time
-	Signature     string
-	RawPayload    map[string]interface{}
+	ID         string
+	ServerID   string
+	Command    string
+	Params     map[string]interface{}
+	Nonce      string
+	Timestamp  time.Time
+	Signature  string
+	RawPayload map[string]interface{}
+
+	// Instance is the target PostgreSQL instance, empty when the agent
+	// monitors only one.
+	Instance string
 }
 
 // CommandResultPayload is sent after executing a command.
 type CommandResultPayload struct {
 	CommandID  string                 `json:"command_id"`
+	InstanceID string                 `json:"instance_id,omitempty"`
 	Status     string                 `json:"status"` // success, failed, rejected
 	Result     map[string]interface{} `json:"result,omitempty"`
 	Error      string                 `json:"error,omitempty"`
 	DurationMs int64                  `json:"duration_ms,omitempty"`
 }
 
+// CommandProgressPayload reports progress of a long-running command.
+type CommandProgressPayload struct {
+	CommandID string `json:"command_id"`
+	Step      string `json:"step,omitempty"`
+	Percent   int    `json:"percent,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// BatchPayload carries several messages in one frame.
+type BatchPayload struct {
+	Messages []Message `json:"messages"`
+}
+
+// ConfigUpdatePayload is received when the control plane changes the
+// agent's runtime configuration. Omitted fields are left unchanged.
+type ConfigUpdatePayload struct {
+	ID                     string          `json:"id"`
+	MetricsIntervalSeconds int             `json:"metrics_interval_seconds,omitempty"`
+	Collectors             map[string]bool `json:"collectors,omitempty"`
+	LogLevel               string          `json:"log_level,omitempty"`
+	CommandsEnabled        *bool           `json:"commands_enabled,omitempty"`
+}
+
+// EffectiveConfig is the runtime configuration currently in force.
+type EffectiveConfig struct {
+	MetricsIntervalSeconds int             `json:"metrics_interval_seconds"`
+	Collectors             map[string]bool `json:"collectors,omitempty"`
+	LogLevel               string          `json:"log_level,omitempty"`
+	CommandsEnabled        bool            `json:"commands_enabled"`
+}
+
+// ConfigAckPayload is sent after a config update has been processed.
+type ConfigAckPayload struct {
+	UpdateID  string          `json:"update_id"`
+	Status    string          `json:"status"` // applied, rejected
+	Error     string          `json:"error,omitempty"`
+	Effective EffectiveConfig `json:"effective"`
+}
+
+// MinMetricsIntervalSeconds is the shortest interval a config update may set.
+const MinMetricsIntervalSeconds = 10
+
 // Config holds the client configuration.
 type Config struct {
 	URL             string
 	Token           string
+	AuthMode        string // AuthBearer (default) or AuthChallenge
 	AgentVersion    string
 	Hostname        string
 	OS              string
 	Arch            string
 	PostgresVersion string
 
+	// Instances are announced in agent_hello when the agent monitors
+	// several PostgreSQL clusters. Commands must then name one of them.
+	Instances []InstanceInfo
+
+	// PostgresVersionFunc, if set, returns the version of the instance with
+	// the given ID (empty for a single instance) at every handshake,
+	// replacing PostgresVersion and the instances' versions. PostgreSQL may
+	// only come up after the agent.
+	PostgresVersionFunc func(instanceID string) string
+
+	// Identity signs agent_hello when set.
+	Identity *identity.Identity
+
+	// DisableCompression turns off permessage-deflate negotiation.
+	DisableCompression bool
+
+	// TLSConfig is used for wss:// connections (custom CAs, mutual TLS).
+	// Nil uses the system defaults.
+	TLSConfig *tls.Config
+
+	// Proxy selects the proxy for the WebSocket connection. Nil connects
+	// directly.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Capabilities advertised in agent_hello. Defaults to DefaultCapabilities.
+	Capabilities []string
+
 	// Reconnection settings
 	InitialBackoff time.Duration
 	MaxBackoff     time.Duration
 	BackoffFactor  float64
+	BackoffJitter  string // JitterFull (default), JitterDecorrelated or JitterNone
 
 	// Ping interval for keepalive
 	PingInterval time.Duration
+
+	// MaxMissedPongs is how many consecutive pings may go unanswered
+	// before the connection is declared dead. The read deadline is
+	// PingInterval * (MaxMissedPongs + 1).
+	MaxMissedPongs int
+
+	// MetricsInterval is the local collection interval, used until the
+	// control plane provides one in the welcome message.
+	MetricsInterval time.Duration
+
+	// BackfillInterval is the minimum delay between replayed batches.
+	BackfillInterval time.Duration
+
+	// Endpoints lists control plane URLs in priority order. The manager
+	// fails over to the next one when an endpoint is unreachable and moves
+	// back after FailbackCooldown. Defaults to just URL.
+	Endpoints        []string
+	FailbackCooldown time.Duration
+
+	// SendQueueSize bounds the outbound message queue. See outbox for the
+	// drop policy when it is full.
+	SendQueueSize int
 }
 
 // DefaultConfig returns config with sensible defaults.
@@ -117,8 +372,35 @@ func (c Config) WithDefaults() Config {
 	if c.BackoffFactor == 0 {
 		c.BackoffFactor = 2.0
 	}
+	if c.BackoffJitter == "" {
+		c.BackoffJitter = JitterFull
+	}
 	if c.PingInterval == 0 {
 		c.PingInterval = 30 * time.Second
 	}
+	if c.MaxMissedPongs == 0 {
+		c.MaxMissedPongs = 3
+	}
+	if c.MetricsInterval == 0 {
+		c.MetricsInterval = 30 * time.Second
+	}
+	if c.BackfillInterval == 0 {
+		c.BackfillInterval = 200 * time.Millisecond
+	}
+	if c.SendQueueSize == 0 {
+		c.SendQueueSize = 256
+	}
+	if len(c.Endpoints) == 0 {
+		c.Endpoints = []string{c.URL}
+	}
+	if c.FailbackCooldown == 0 {
+		c.FailbackCooldown = 5 * time.Minute
+	}
+	if c.AuthMode == "" {
+		c.AuthMode = AuthBearer
+	}
+	if c.Capabilities == nil {
+		c.Capabilities = append([]string(nil), DefaultCapabilities...)
+	}
 	return c
 }
@@ -0,0 +1,221 @@
+// Package control implements the agent's local control socket, a unix
+// socket over which CLI subcommands such as status talk to the running
+// daemon.
+//
+// Each connection carries one request and one response, both single
+// lines of JSON.
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Request asks the daemon to perform an operation.
+type Request struct {
+	Op string `json:"op"`
+}
+
+// Response carries the result of an operation, or the reason it failed.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Handler performs an operation and returns a JSON-encodable result.
+type Handler func(ctx context.Context) (any, error)
+
+// requestTimeout bounds how long a client may take to send its request and
+// a handler to answer it.
+const requestTimeout = 10 * time.Second
+
+// Server serves operations on a unix socket.
+type Server struct {
+	path     string
+	handlers map[string]Handler
+	listener net.Listener
+	logger   *slog.Logger
+	mu       sync.RWMutex
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a server for the socket at path.
+func NewServer(path string) *Server {
+	return &Server{
+		path:     path,
+		handlers: make(map[string]Handler),
+		logger:   slog.Default(),
+	}
+}
+
+// SetLogger sets a custom logger.
+func (s *Server) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// Handle registers the handler for an operation.
+func (s *Server) Handle(op string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[op] = handler
+}
+
+// Start listens on the socket and serves requests in the background. A
+// stale socket left by a previous run is replaced, but one that another
+// agent is still listening on is not.
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("create control socket directory: %w", err)
+	}
+
+	if conn, err := net.DialTimeout("unix", s.path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use by another agent", s.path)
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale control socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("listen on control socket: %w", err)
+	}
+	// The socket exposes agent state, so keep it to the owner and group
+	if err := os.Chmod(s.path, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("chmod control socket: %w", err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+// Close stops serving, waits for requests in progress and removes the
+// socket.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("control socket accept failed", "error", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle answers the request on one connection.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	var resp Response
+	var req Request
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else {
+		resp = s.dispatch(req)
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		s.logger.Error("marshal control response", "op", req.Op, "error", err)
+		return
+	}
+	conn.Write(append(data, '\n'))
+}
+
+// dispatch runs the handler for a request.
+func (s *Server) dispatch(req Request) Response {
+	s.mu.RLock()
+	handler, ok := s.handlers[req.Op]
+	s.mu.RUnlock()
+	if !ok {
+		return Response{Error: fmt.Sprintf("unknown operation: %s", req.Op)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	result, err := handler(ctx)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return Response{Error: fmt.Sprintf("marshal result: %v", err)}
+	}
+	return Response{Result: data}
+}
+
+// Call performs an operation on the daemon listening at path and decodes
+// its result into result.
+func Call(ctx context.Context, path, op string, result any) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return fmt.Errorf("connect to agent (is it running?): %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	data, err := json.Marshal(Request{Op: op})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("decode result: %w", err)
+	}
+	return nil
+}
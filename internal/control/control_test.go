@@ -0,0 +1,97 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server := NewServer(path)
+	server.Handle("status", func(ctx context.Context) (any, error) {
+		return map[string]string{"state": "connected"}, nil
+	})
+	server.Handle("broken", func(ctx context.Context) (any, error) {
+		return nil, errors.New("something went wrong")
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, path
+}
+
+func TestCall(t *testing.T) {
+	_, path := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var status map[string]string
+	if err := Call(ctx, path, "status", &status); err != nil {
+		t.Fatalf("Call(status) error = %v", err)
+	}
+	if status["state"] != "connected" {
+		t.Errorf("state = %q, want connected", status["state"])
+	}
+
+	if err := Call(ctx, path, "broken", nil); err == nil || err.Error() != "something went wrong" {
+		t.Errorf("Call(broken) error = %v, want the handler's error", err)
+	}
+	if err := Call(ctx, path, "bogus", nil); err == nil || !strings.Contains(err.Error(), "unknown operation") {
+		t.Errorf("Call(bogus) error = %v, want unknown operation", err)
+	}
+}
+
+func TestServer_SocketPermissions(t *testing.T) {
+	_, path := startServer(t)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("socket permissions = %o, want 660", perm)
+	}
+}
+
+func TestServer_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	// A socket file nobody listens on, as left by a crashed agent
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	server := NewServer(path)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() over a stale socket error = %v", err)
+	}
+	defer server.Close()
+
+	// A second agent must not take over a live socket
+	if err := NewServer(path).Start(); err == nil {
+		t.Error("Start() should fail while another server is listening")
+	}
+}
+
+func TestServer_CloseRemovesSocket(t *testing.T) {
+	server, path := startServer(t)
+	server.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still exists after Close(): %v", err)
+	}
+	if err := Call(context.Background(), path, "status", nil); err == nil {
+		t.Error("Call() should fail after Close()")
+	}
+}
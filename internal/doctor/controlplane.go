@@ -0,0 +1,255 @@
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/connection"
+	"github.com/deploydb/agent/internal/control"
+	"github.com/deploydb/agent/internal/identity"
+	"github.com/deploydb/agent/internal/proxy"
+	"github.com/deploydb/agent/internal/tlsconfig"
+)
+
+// checkControlPlane checks that endpoint resolves, presents a trusted
+// certificate, agrees on the time and accepts the agent's token. Later
+// checks are skipped once one fails.
+func checkControlPlane(ctx context.Context, report *Report, name, endpoint string, cfg *config.Config, opts Options) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		report.add(name+" url", Fail, fmt.Sprintf("invalid control plane URL %q", endpoint),
+			"set control_plane_url to the wss:// URL shown in the dashboard")
+		return
+	}
+
+	proxyFunc, err := proxy.Config{URL: cfg.Proxy.URL, NoProxy: cfg.Proxy.NoProxy}.Func()
+	if err != nil {
+		report.add(name+" proxy", Fail, err.Error(), "fix proxy.url")
+		return
+	}
+
+	// The WebSocket endpoint also answers plain HTTP(S) requests
+	probeURL := *u
+	probeURL.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	proxyURL, _ := proxyFunc(&http.Request{URL: &probeURL})
+
+	if !checkDNS(ctx, report, name, u.Hostname(), proxyURL, opts) {
+		return
+	}
+
+	tlsConfig, err := tlsconfig.Build(tlsconfig.Options{
+		CAFile:   cfg.ControlPlaneTLS.CAFile,
+		CertFile: cfg.ControlPlaneTLS.CertFile,
+		KeyFile:  cfg.ControlPlaneTLS.KeyFile,
+		Pins:     cfg.ControlPlaneTLS.Pins,
+	})
+	if err != nil {
+		report.add(name+" tls", Fail, err.Error(), "check the files and pins under control_plane_tls")
+		return
+	}
+
+	resp, ok := checkTLS(ctx, report, name, &probeURL, tlsConfig, proxyFunc, opts)
+	if !ok {
+		return
+	}
+	checkClock(report, name, resp, opts)
+	checkAuth(ctx, report, name, endpoint, cfg, tlsConfig, proxyFunc, opts)
+}
+
+// checkDNS resolves host. A failure is only a warning when a proxy
+// resolves names on the agent's behalf.
+func checkDNS(ctx context.Context, report *Report, name, host string, proxyURL *url.URL, opts Options) bool {
+	if net.ParseIP(host) != nil {
+		report.add(name+" dns", Pass, host+" is an IP address", "")
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	addrs, err := opts.Resolver.LookupHost(ctx, host)
+	if err != nil {
+		if proxyURL != nil {
+			report.add(name+" dns", Warn, fmt.Sprintf("cannot resolve %s locally: %v", host, err),
+				fmt.Sprintf("connections go through the proxy %s, which resolves the name itself", proxyURL.Host))
+			return true
+		}
+		report.add(name+" dns", Fail, fmt.Sprintf("cannot resolve %s: %v", host, err),
+			"check the host in control_plane_url and the DNS servers in /etc/resolv.conf, or set proxy if outbound traffic must use one")
+		return false
+	}
+	report.add(name+" dns", Pass, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), "")
+	return true
+}
+
+// checkTLS makes an HTTP(S) request to the control plane, which exercises
+// the proxy, the TLS handshake and certificate verification including
+// pins. Any HTTP status will do.
+func checkTLS(ctx context.Context, report *Report, name string, probeURL *url.URL, tlsConfig *tls.Config,
+	proxyFunc func(*http.Request) (*url.URL, error), opts Options) (*http.Response, bool) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc
+	transport.TLSClientConfig = tlsConfig
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		report.add(name+" tls", Fail, err.Error(), "")
+		return nil, false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		check := name + " tls"
+		if probeURL.Scheme == "http" {
+			check = name + " reachable"
+		}
+		report.add(check, Fail, err.Error(), tlsHint(err, probeURL))
+		return nil, false
+	}
+	resp.Body.Close()
+
+	if resp.TLS == nil {
+		report.add(name+" tls", Warn, "the control plane URL is not encrypted", "use a wss:// URL outside of local testing")
+		return resp, true
+	}
+
+	leaf := resp.TLS.PeerCertificates[0]
+	message := fmt.Sprintf("%s, certificate for %s valid until %s",
+		tls.VersionName(resp.TLS.Version), leaf.Subject.CommonName, leaf.NotAfter.Format(time.DateOnly))
+	if leaf.NotAfter.Sub(opts.Now()) < certExpiryWarning {
+		report.add(name+" tls", Warn, message, "the control plane certificate expires soon; renew it if you run a private control plane")
+	} else {
+		report.add(name+" tls", Pass, message, "")
+	}
+	return resp, true
+}
+
+// tlsHint suggests a fix for a failed control plane request.
+func tlsHint(err error, probeURL *url.URL) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "the certificate is not signed by a trusted CA: set control_plane_tls.ca_file for a private control plane, or check for a TLS-intercepting proxy"
+	case errors.As(err, &hostname):
+		return "the certificate does not match the host in control_plane_url"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "the certificate is expired or not yet valid: check the system clock"
+	case errors.Is(err, tlsconfig.ErrPinMismatch):
+		return "no certificate in the chain matches control_plane_tls.pins: update the pins if the control plane key was rotated"
+	default:
+		return fmt.Sprintf("check that the firewall or proxy allows outbound connections to %s", probeURL.Host)
+	}
+}
+
+// checkClock compares the local clock with the Date header of the control
+// plane's response.
+func checkClock(report *Report, name string, resp *http.Response, opts Options) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		report.add(name+" clock", Warn, "the control plane sent no Date header, clock skew not checked", "")
+		return
+	}
+
+	skew := opts.Now().Sub(date)
+	direction := "ahead of"
+	if skew < 0 {
+		skew, direction = -skew, "behind"
+	}
+	// Date has a resolution of one second
+	skew = skew.Truncate(time.Second)
+
+	hint := "enable time synchronisation, e.g. `timedatectl set-ntp true` or chrony"
+	message := fmt.Sprintf("local clock is %s %s the control plane", skew, direction)
+	switch {
+	case skew >= maxSkew:
+		report.add(name+" clock", Fail, message, hint)
+	case skew >= warnSkew:
+		report.add(name+" clock", Warn, message, hint)
+	default:
+		report.add(name+" clock", Pass, fmt.Sprintf("local clock is within %s of the control plane", warnSkew), "")
+	}
+}
+
+// agentStatus is the part of the daemon's status that checkAuth needs.
+type agentStatus struct {
+	State    string `json:"state"`
+	Endpoint string `json:"endpoint"`
+	ServerID string `json:"server_id"`
+}
+
+// checkAuth opens the agent's WebSocket connection and closes it before
+// agent_hello, so it never starts a session. In bearer mode the upgrade
+// itself checks the token. While the running agent is connected, its
+// session is reported instead.
+func checkAuth(ctx context.Context, report *Report, name, endpoint string, cfg *config.Config, tlsConfig *tls.Config,
+	proxyFunc func(*http.Request) (*url.URL, error), opts Options) {
+	if cfg.ControlSocket != "" {
+		var status agentStatus
+		statusCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := control.Call(statusCtx, cfg.ControlSocket, "status", &status)
+		cancel()
+		if err == nil && status.State == "connected" {
+			report.add(name+" auth", Pass, fmt.Sprintf("the running agent is connected to %s as server %s", status.Endpoint, status.ServerID), "")
+			return
+		}
+	}
+
+	// The agent signs its hello with this key; never create one here
+	_, err := identity.Load(cfg.IdentityKey)
+	switch {
+	case err != nil && cfg.AuthMode == connection.AuthChallenge:
+		report.add(name+" auth", Fail, err.Error(),
+			"challenge auth signs with the identity key registered by bootstrap: restore identity_key or set auth_mode: bearer")
+		return
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		report.add(name+" identity", Warn, err.Error(), "make identity_key readable by the agent, or remove it to generate a new one")
+	}
+
+	client := connection.NewClient(connection.Config{
+		URL:       endpoint,
+		Token:     cfg.Token,
+		AuthMode:  cfg.AuthMode,
+		TLSConfig: tlsConfig,
+		Proxy:     proxyFunc,
+	})
+	client.SetLogger(slog.New(slog.DiscardHandler))
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	if err := client.Probe(ctx); err != nil {
+		hint := "check the control plane status and retry"
+		var serverErr *connection.ServerError
+		if errors.As(err, &serverErr) && serverErr.Unauthorized() {
+			hint = "the token was rejected: copy it again from the dashboard into token or token_file"
+		}
+		report.add(name+" auth", Fail, err.Error(), hint)
+		return
+	}
+
+	if cfg.AuthMode == connection.AuthChallenge {
+		report.add(name+" auth", Pass, "auth challenge received, the identity key is verified when the agent connects", "")
+		return
+	}
+	report.add(name+" auth", Pass, "token accepted", "")
+}
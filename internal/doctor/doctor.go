@@ -0,0 +1,122 @@
+// Package doctor runs preflight checks of everything the agent depends on:
+// its config file, the control plane (DNS, TLS, clock and authentication)
+// and each PostgreSQL instance (connectivity, privileges, extensions and
+// disk access). Each problem comes with a remediation hint.
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	// Pass means the check found no problem.
+	Pass Status = "pass"
+	// Warn means the agent works, but with reduced functionality.
+	Warn Status = "warn"
+	// Fail means the agent cannot work until the problem is fixed.
+	Fail Status = "fail"
+)
+
+// Result is the outcome of one check.
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Report lists the results in the order the checks ran.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Failed reports whether any check failed.
+func (r Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configures a run.
+type Options struct {
+	// ConfigPath is the config file to check.
+	ConfigPath string
+
+	// Timeout bounds each network check. Defaults to 10s.
+	Timeout time.Duration
+
+	// Resolver looks up control plane hosts. Nil uses net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// Now returns the local time for the clock skew check. Defaults to
+	// time.Now.
+	Now func() time.Time
+}
+
+// Clock skew thresholds. Signed handshakes and certificate checks start
+// failing well before maxSkew, but a few seconds are normal.
+const (
+	warnSkew = 30 * time.Second
+	maxSkew  = 5 * time.Minute
+)
+
+// certExpiryWarning is how long before a control plane certificate
+// expires the TLS check warns.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Run loads the config file and runs every check. When the config cannot
+// be loaded, the report contains only that failure.
+func Run(ctx context.Context, opts Options) Report {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+
+	var report Report
+	cfg, err := config.Load(opts.ConfigPath)
+	if err != nil {
+		report.add("config", Fail, err.Error(),
+			"fix the file, then run `deploydb-agent config show` to see the effective settings")
+		return report
+	}
+	report.add("config", Pass, fmt.Sprintf("%s is valid", opts.ConfigPath), "")
+
+	endpoints := cfg.Endpoints()
+	for _, endpoint := range endpoints {
+		name := "control plane"
+		if len(endpoints) > 1 {
+			name += " " + endpoint
+		}
+		checkControlPlane(ctx, &report, name, endpoint, cfg, opts)
+	}
+
+	for _, instance := range cfg.Instances() {
+		name := "postgres"
+		if instance.ID != "" {
+			name += " " + instance.ID
+		}
+		checkPostgres(ctx, &report, name, instance.PostgresConfig, opts)
+	}
+	return report
+}
+
+// add appends a result.
+func (r *Report) add(check string, status Status, message, hint string) {
+	r.Results = append(r.Results, Result{Check: check, Status: status, Message: message, Hint: hint})
+}
@@ -0,0 +1,253 @@
+package doctor
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/control"
+)
+
+func testOptions() Options {
+	return Options{
+		Timeout:  5 * time.Second,
+		Resolver: net.DefaultResolver,
+		Now:      time.Now,
+	}
+}
+
+// find returns the result of a check, failing the test if it did not run.
+func find(t *testing.T, report Report, check string) Result {
+	t.Helper()
+	for _, result := range report.Results {
+		if result.Check == check {
+			return result
+		}
+	}
+	t.Fatalf("check %q missing from report: %+v", check, report.Results)
+	return Result{}
+}
+
+func TestRun_InvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("token: \"\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report := Run(context.Background(), Options{ConfigPath: path})
+
+	if len(report.Results) != 1 {
+		t.Fatalf("got %d results, want only the config check", len(report.Results))
+	}
+	if result := report.Results[0]; result.Check != "config" || result.Status != Fail || result.Hint == "" {
+		t.Errorf("result = %+v, want a failed config check with a hint", result)
+	}
+	if !report.Failed() {
+		t.Error("Failed() = false, want true")
+	}
+}
+
+// tlsControlPlane starts a TLS server that rejects the WebSocket upgrade
+// with 401 and returns its URL and a CA file trusting it.
+func tlsControlPlane(t *testing.T) (string, string) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(server.URL, "https", "wss", 1) + "/agent/ws", caFile
+}
+
+func TestCheckControlPlane(t *testing.T) {
+	endpoint, caFile := tlsControlPlane(t)
+	cfg := &config.Config{
+		Token:           "ddb_revoked",
+		AuthMode:        "bearer",
+		IdentityKey:     filepath.Join(t.TempDir(), "identity.key"),
+		ControlPlaneTLS: config.ClientTLS{CAFile: caFile},
+	}
+
+	var report Report
+	checkControlPlane(context.Background(), &report, "control plane", endpoint, cfg, testOptions())
+
+	for _, check := range []string{"control plane dns", "control plane tls", "control plane clock"} {
+		if result := find(t, report, check); result.Status != Pass {
+			t.Errorf("%s = %+v, want pass", check, result)
+		}
+	}
+	auth := find(t, report, "control plane auth")
+	if auth.Status != Fail || !strings.Contains(auth.Hint, "token") {
+		t.Errorf("auth = %+v, want a failure pointing at the token", auth)
+	}
+}
+
+func TestCheckControlPlane_AgentConnected(t *testing.T) {
+	endpoint, caFile := tlsControlPlane(t)
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	server := control.NewServer(socket)
+	server.Handle("status", func(ctx context.Context) (any, error) {
+		return map[string]string{"state": "connected", "endpoint": endpoint, "server_id": "srv_1"}, nil
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	cfg := &config.Config{
+		Token:           "ddb_revoked",
+		AuthMode:        "bearer",
+		ControlSocket:   socket,
+		ControlPlaneTLS: config.ClientTLS{CAFile: caFile},
+	}
+
+	var report Report
+	checkControlPlane(context.Background(), &report, "control plane", endpoint, cfg, testOptions())
+
+	// The control plane rejects every hello, so a pass means none was sent
+	auth := find(t, report, "control plane auth")
+	if auth.Status != Pass || !strings.Contains(auth.Message, "srv_1") {
+		t.Errorf("auth = %+v, want a pass reporting the running agent's session", auth)
+	}
+}
+
+func TestCheckControlPlane_ChallengeNeedsIdentity(t *testing.T) {
+	endpoint, caFile := tlsControlPlane(t)
+	cfg := &config.Config{
+		Token:           "ddb_test",
+		AuthMode:        "challenge",
+		IdentityKey:     filepath.Join(t.TempDir(), "identity.key"),
+		ControlPlaneTLS: config.ClientTLS{CAFile: caFile},
+	}
+
+	var report Report
+	checkControlPlane(context.Background(), &report, "control plane", endpoint, cfg, testOptions())
+
+	auth := find(t, report, "control plane auth")
+	if auth.Status != Fail || !strings.Contains(auth.Hint, "identity_key") {
+		t.Errorf("auth = %+v, want a failure pointing at identity_key", auth)
+	}
+}
+
+func TestCheckControlPlane_UntrustedCertificate(t *testing.T) {
+	endpoint, _ := tlsControlPlane(t)
+	cfg := &config.Config{Token: "ddb_test", AuthMode: "bearer"}
+
+	var report Report
+	checkControlPlane(context.Background(), &report, "control plane", endpoint, cfg, testOptions())
+
+	result := find(t, report, "control plane tls")
+	if result.Status != Fail || !strings.Contains(result.Hint, "ca_file") {
+		t.Errorf("tls = %+v, want a failure suggesting ca_file", result)
+	}
+	for _, r := range report.Results {
+		if r.Check == "control plane auth" {
+			t.Error("auth should not be checked after TLS failed")
+		}
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	serverTime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   Status
+	}{
+		{"in sync", 2 * time.Second, Pass},
+		{"ahead", time.Minute, Warn},
+		{"behind", -time.Minute, Warn},
+		{"far off", 10 * time.Minute, Fail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{"Date": {serverTime.Format(http.TimeFormat)}}}
+			opts := testOptions()
+			opts.Now = func() time.Time { return serverTime.Add(tt.offset) }
+
+			var report Report
+			checkClock(&report, "control plane", resp, opts)
+			if got := report.Results[0].Status; got != tt.want {
+				t.Errorf("status = %s, want %s (%s)", got, tt.want, report.Results[0].Message)
+			}
+		})
+	}
+}
+
+func TestCheckDNS(t *testing.T) {
+	opts := testOptions()
+	opts.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("no DNS server")
+		},
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: "proxy.internal:3128"}
+
+	tests := []struct {
+		name     string
+		host     string
+		proxyURL *url.URL
+		want     Status
+	}{
+		{"ip address", "192.0.2.1", nil, Pass},
+		{"unresolvable", "control.example.invalid", nil, Fail},
+		{"unresolvable behind proxy", "control.example.invalid", proxyURL, Warn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var report Report
+			ok := checkDNS(context.Background(), &report, "control plane", tt.host, tt.proxyURL, opts)
+			if got := report.Results[0].Status; got != tt.want {
+				t.Errorf("status = %s, want %s (%s)", got, tt.want, report.Results[0].Message)
+			}
+			if ok != (tt.want != Fail) {
+				t.Errorf("checkDNS() = %t, want %t", ok, tt.want != Fail)
+			}
+		})
+	}
+}
+
+func TestCheckPostgres_Unreachable(t *testing.T) {
+	pg := config.PostgresConfig{Host: "127.0.0.1", Port: freePort(t), User: "agent", SSLMode: "disable"}
+
+	var report Report
+	checkPostgres(context.Background(), &report, "postgres", pg, testOptions())
+
+	result := find(t, report, "postgres connection")
+	if result.Status != Fail || !strings.Contains(result.Hint, "listening") {
+		t.Errorf("connection = %+v, want a failure asking whether PostgreSQL is listening", result)
+	}
+	if len(report.Results) != 1 {
+		t.Errorf("got %d results, want the other checks skipped", len(report.Results))
+	}
+}
+
+// freePort returns a local TCP port nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
@@ -0,0 +1,147 @@
+package doctor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/lib/pq"
+
+	"github.com/deploydb/agent/internal/collector"
+	"github.com/deploydb/agent/internal/config"
+	"github.com/deploydb/agent/internal/postgres"
+)
+
+// checkPostgres checks that the instance accepts the agent's connection
+// and that the agent can read everything it collects.
+func checkPostgres(ctx context.Context, report *Report, name string, pg config.PostgresConfig, opts Options) {
+	connectCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	db, err := postgres.Open(connectCtx, pg)
+	cancel()
+	if err != nil {
+		report.add(name+" connection", Fail, err.Error(), connectHint(err, pg))
+		return
+	}
+	defer db.Close()
+
+	var version string
+	if err := db.QueryRowContext(ctx, "SHOW server_version").Scan(&version); err != nil {
+		version = "unknown version"
+	}
+	report.add(name+" connection", Pass, fmt.Sprintf("connected to %s as %s (PostgreSQL %s)", pg.Host, pg.User, version), "")
+
+	checkMonitorRole(ctx, report, name, db, pg.User)
+	checkStatStatements(ctx, report, name, db)
+	checkDisk(ctx, report, name, db, pg.DataDir)
+}
+
+// connectHint suggests a fix for a failed connection.
+func connectHint(err error, pg config.PostgresConfig) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "28P01":
+			return "the password was rejected: check password, password_file or .pgpass"
+		case "28000":
+			return fmt.Sprintf("add a pg_hba.conf entry allowing %s to connect from this host, then reload PostgreSQL", pg.User)
+		case "3D000":
+			return "the database does not exist: set postgres.database to an existing database such as postgres"
+		case "53300":
+			return "the server is out of connection slots: raise max_connections or reserve some for monitoring"
+		}
+		return ""
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, os.ErrNotExist) {
+		return fmt.Sprintf("is PostgreSQL running and listening on %s port %d? check listen_addresses and port", pg.Host, pg.Port)
+	}
+	if errors.Is(err, pq.ErrSSLNotSupported) {
+		return "the server does not support SSL: enable ssl on the server or lower sslmode"
+	}
+	if strings.Contains(err.Error(), "target_session_attrs") {
+		return "point the agent at a server of the right role, or relax target_session_attrs"
+	}
+	return "check host, port and sslmode"
+}
+
+// checkMonitorRole warns if the role cannot read all statistics.
+func checkMonitorRole(ctx context.Context, report *Report, name string, db *sql.DB, user string) {
+	var superuser, monitor bool
+	err := db.QueryRowContext(ctx, `
+		SELECT rolsuper, pg_has_role(current_user, 'pg_monitor', 'member')
+		FROM pg_roles WHERE rolname = current_user`).Scan(&superuser, &monitor)
+	if err != nil {
+		// pg_monitor was added in PostgreSQL 10
+		report.add(name+" privileges", Warn, fmt.Sprintf("cannot check pg_monitor membership: %v", err),
+			fmt.Sprintf("grant %s superuser or read access to the statistics views", user))
+		return
+	}
+
+	switch {
+	case superuser:
+		report.add(name+" privileges", Pass, fmt.Sprintf("%s is a superuser", user), "")
+	case monitor:
+		report.add(name+" privileges", Pass, fmt.Sprintf("%s is a member of pg_monitor", user), "")
+	default:
+		report.add(name+" privileges", Warn,
+			fmt.Sprintf("%s is not a member of pg_monitor, so other sessions' queries and some settings are hidden", user),
+			fmt.Sprintf("run: GRANT pg_monitor TO %s;", pq.QuoteIdentifier(user)))
+	}
+}
+
+// checkStatStatements warns if pg_stat_statements is missing or not loaded.
+func checkStatStatements(ctx context.Context, report *Report, name string, db *sql.DB) {
+	hint := "add pg_stat_statements to shared_preload_libraries, restart PostgreSQL, then run: CREATE EXTENSION pg_stat_statements;"
+
+	var version string
+	err := db.QueryRowContext(ctx,
+		"SELECT extversion FROM pg_extension WHERE extname = 'pg_stat_statements'").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		report.add(name+" pg_stat_statements", Warn, "the pg_stat_statements extension is not installed, query statistics are unavailable", hint)
+		return
+	}
+	if err != nil {
+		report.add(name+" pg_stat_statements", Warn, fmt.Sprintf("cannot check extensions: %v", err), "")
+		return
+	}
+
+	// Installed but not preloaded fails on first use
+	if _, err := db.ExecContext(ctx, "SELECT 1 FROM pg_stat_statements LIMIT 1"); err != nil {
+		report.add(name+" pg_stat_statements", Warn, fmt.Sprintf("pg_stat_statements %s is installed but not usable: %v", version, err), hint)
+		return
+	}
+	report.add(name+" pg_stat_statements", Pass, fmt.Sprintf("pg_stat_statements %s is installed", version), "")
+}
+
+// checkDisk runs the disk collector for the instance, which needs read
+// access to the data directory.
+func checkDisk(ctx context.Context, report *Report, name string, db *sql.DB, dataDir string) {
+	c := collector.New(collector.Config{DB: db, DataDir: dataDir})
+	metrics, err := c.Run(ctx, collector.CollectorDisk)
+	if err != nil || len(metrics) == 0 {
+		message := "no disk metrics collected"
+		if err != nil {
+			message = err.Error()
+		}
+		report.add(name+" data directory", Warn, message,
+			"run the agent as a user that can access the data directory (e.g. in the postgres group), or set data_dir")
+		return
+	}
+
+	mounts := 0
+	for series := range metrics {
+		if collector.MetricName(series) != "system_mount_total_bytes" {
+			continue
+		}
+		_, labels := collector.ParseSeries(series)
+		for _, label := range labels {
+			if label.Name == collector.LabelMountpoint {
+				mounts++
+			}
+		}
+	}
+	report.add(name+" data directory", Pass, fmt.Sprintf("disk metrics available for %d filesystem(s)", mounts), "")
+}
@@ -0,0 +1,274 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+)
+
+// OTLP resource attribute keys.
+const (
+	AttrServiceName     = "service.name"
+	AttrServiceVersion  = "service.version"
+	AttrHostName        = "host.name"
+	AttrHostArch        = "host.arch"
+	AttrOSType          = "os.type"
+	AttrServerID        = "deploydb.server_id"
+	AttrPostgresVersion = "postgresql.version"
+)
+
+// OTLPConfig holds the OTLP/HTTP exporter configuration.
+type OTLPConfig struct {
+	// Endpoint is the collector base URL (e.g. http://localhost:4318).
+	// "/v1/metrics" is appended unless already present.
+	Endpoint string
+	Headers  map[string]string
+	Timeout  time.Duration
+
+	// Resource holds the initial resource attributes.
+	Resource map[string]string
+
+	// Proxy selects the proxy for export requests. Nil uses the
+	// environment.
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// OTLPExporter pushes metrics to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding. It implements connection.MetricsSink.
+type OTLPExporter struct {
+	config     OTLPConfig
+	url        string
+	client     *http.Client
+	mu         sync.RWMutex
+	attributes map[string]string
+	logger     *slog.Logger
+}
+
+// NewOTLPExporter creates a new OTLP exporter.
+func NewOTLPExporter(config OTLPConfig) *OTLPExporter {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	endpoint := strings.TrimRight(config.Endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/metrics") {
+		endpoint += "/v1/metrics"
+	}
+
+	attributes := make(map[string]string, len(config.Resource))
+	for k, v := range config.Resource {
+		attributes[k] = v
+	}
+
+	client := &http.Client{Timeout: config.Timeout}
+	if config.Proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = config.Proxy
+		client.Transport = transport
+	}
+
+	return &OTLPExporter{
+		config:     config,
+		url:        endpoint,
+		client:     client,
+		attributes: attributes,
+		logger:     slog.Default(),
+	}
+}
+
+// SetLogger sets the logger for the exporter.
+func (e *OTLPExporter) SetLogger(logger *slog.Logger) {
+	e.logger = logger
+}
+
+// SetResourceAttribute sets or replaces a resource attribute. Empty values
+// remove the attribute.
+func (e *OTLPExporter) SetResourceAttribute(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if value == "" {
+		delete(e.attributes, key)
+		return
+	}
+	e.attributes[key] = value
+}
+
+// Name returns the sink name.
+func (e *OTLPExporter) Name() string {
+	return "otlp"
+}
+
+// SendMetrics exports one batch of metrics.
+func (e *OTLPExporter) SendMetrics(ctx context.Context, timestamp time.Time, metrics map[string]float64) error {
+	body, err := json.Marshal(e.buildRequest(timestamp, metrics))
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	// Drain so the connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// OTLP/JSON request structures (opentelemetry-proto, metrics v1).
+// Only the subset used by the agent is modelled.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano string         `json:"timeUnixNano"`
+	AsDouble     float64        `json:"asDouble"`
+}
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+// seriesAttributes returns the labels of a series as data point attributes.
+func seriesAttributes(series string) []otlpKeyValue {
+	_, labels := collector.ParseSeries(series)
+	if len(labels) == 0 {
+		return nil
+	}
+	attributes := make([]otlpKeyValue, len(labels))
+	for i, label := range labels {
+		attributes[i] = otlpKeyValue{Key: label.Name, Value: otlpAnyValue{StringValue: label.Value}}
+	}
+	return attributes
+}
+
+// buildRequest converts a metrics batch into an OTLP export request.
+func (e *OTLPExporter) buildRequest(timestamp time.Time, metrics map[string]float64) otlpRequest {
+	e.mu.RLock()
+	keys := make([]string, 0, len(e.attributes))
+	for k := range e.attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attributes := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		attributes = append(attributes, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: e.attributes[k]}})
+	}
+	version := e.attributes[AttrServiceVersion]
+	e.mu.RUnlock()
+
+	ts := strconv.FormatInt(timestamp.UnixNano(), 10)
+	families := groupSeries(metrics)
+	out := make([]otlpMetric, 0, len(families))
+	for _, f := range families {
+		desc := collector.Describe(f.name)
+		points := make([]otlpDataPoint, 0, len(f.series))
+		for _, series := range f.series {
+			points = append(points, otlpDataPoint{
+				Attributes:   seriesAttributes(series),
+				TimeUnixNano: ts,
+				AsDouble:     metrics[series],
+			})
+		}
+
+		m := otlpMetric{Name: f.name, Unit: desc.Unit}
+		if desc.Help != f.name {
+			m.Description = desc.Help
+		}
+		if desc.Type == collector.Counter {
+			m.Sum = &otlpSum{
+				DataPoints:             points,
+				AggregationTemporality: aggregationTemporalityCumulative,
+				IsMonotonic:            true,
+			}
+		} else {
+			m.Gauge = &otlpGauge{DataPoints: points}
+		}
+		out = append(out, m)
+	}
+
+	return otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: attributes},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "deploydb-agent", Version: version},
+				Metrics: out,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,150 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter_SendMetrics(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	var gotPath, gotAuth, gotContentType string
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		gotContentType = r.Header.Get("Content-Type")
+
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid OTLP body: %v", err)
+		}
+		received <- req
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	exp := NewOTLPExporter(OTLPConfig{
+		Endpoint: receiver.URL,
+		Headers:  map[string]string{"Authorization": "Bearer otel"},
+		Resource: map[string]string{
+			AttrHostName:        "db-1",
+			AttrOSType:          "linux",
+			AttrHostArch:        "amd64",
+			AttrPostgresVersion: "16.2",
+		},
+	})
+	exp.SetResourceAttribute(AttrServerID, "srv_123")
+
+	ts := time.UnixMilli(1700000000000)
+	err := exp.SendMetrics(context.Background(), ts, map[string]float64{
+		"pg_connections_active": 5,
+		"pg_deadlocks_total":    2,
+	})
+	if err != nil {
+		t.Fatalf("SendMetrics() error = %v", err)
+	}
+
+	req := <-received
+
+	if gotPath != "/v1/metrics" {
+		t.Errorf("path = %q, want /v1/metrics", gotPath)
+	}
+	if gotAuth != "Bearer otel" {
+		t.Errorf("Authorization = %q, want %q", gotAuth, "Bearer otel")
+	}
+	if gotContentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", gotContentType)
+	}
+
+	if len(req.ResourceMetrics) != 1 {
+		t.Fatalf("resourceMetrics = %d, want 1", len(req.ResourceMetrics))
+	}
+	rm := req.ResourceMetrics[0]
+
+	attrs := make(map[string]string)
+	for _, kv := range rm.Resource.Attributes {
+		attrs[kv.Key] = kv.Value.StringValue
+	}
+	wantAttrs := map[string]string{
+		AttrHostName:        "db-1",
+		AttrOSType:          "linux",
+		AttrHostArch:        "amd64",
+		AttrPostgresVersion: "16.2",
+		AttrServerID:        "srv_123",
+	}
+	for k, v := range wantAttrs {
+		if attrs[k] != v {
+			t.Errorf("resource attribute %s = %q, want %q", k, attrs[k], v)
+		}
+	}
+
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Fatalf("metrics = %d, want 2", len(metrics))
+	}
+
+	byName := make(map[string]otlpMetric)
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+
+	active := byName["pg_connections_active"]
+	if active.Gauge == nil || len(active.Gauge.DataPoints) != 1 {
+		t.Fatalf("pg_connections_active should be a gauge with one point: %+v", active)
+	}
+	if active.Gauge.DataPoints[0].AsDouble != 5 {
+		t.Errorf("pg_connections_active = %v, want 5", active.Gauge.DataPoints[0].AsDouble)
+	}
+	if active.Gauge.DataPoints[0].TimeUnixNano != "1700000000000000000" {
+		t.Errorf("timeUnixNano = %v", active.Gauge.DataPoints[0].TimeUnixNano)
+	}
+
+	deadlocks := byName["pg_deadlocks_total"]
+	if deadlocks.Sum == nil || !deadlocks.Sum.IsMonotonic {
+		t.Errorf("pg_deadlocks_total should be a monotonic sum: %+v", deadlocks)
+	}
+}
+
+func TestOTLPExporter_LabeledSeries(t *testing.T) {
+	exp := NewOTLPExporter(OTLPConfig{Endpoint: "http://localhost"})
+
+	req := exp.buildRequest(time.Now(), map[string]float64{
+		`pg_connections_active{instance_id="main"}`: 5,
+		`pg_connections_active{instance_id="pg15"}`: 2,
+	})
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 1 || metrics[0].Name != "pg_connections_active" {
+		t.Fatalf("metrics = %+v, want one pg_connections_active", metrics)
+	}
+	points := metrics[0].Gauge.DataPoints
+	if len(points) != 2 {
+		t.Fatalf("data points = %d, want one per instance", len(points))
+	}
+	for i, want := range []string{"main", "pg15"} {
+		attrs := points[i].Attributes
+		if len(attrs) != 1 || attrs[0].Key != "instance_id" || attrs[0].Value.StringValue != want {
+			t.Errorf("point %d attributes = %+v, want instance_id=%s", i, attrs, want)
+		}
+	}
+}
+
+func TestOTLPExporter_ErrorStatus(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	exp := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL + "/v1/metrics"})
+
+	err := exp.SendMetrics(context.Background(), time.Now(), map[string]float64{"x": 1})
+	if err == nil {
+		t.Fatal("SendMetrics() should fail on 400")
+	}
+}
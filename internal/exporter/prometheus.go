@@ -0,0 +1,229 @@
+// Package exporter exposes collected metrics to third-party monitoring systems.
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deploydb/agent/internal/collector"
+)
+
+// GatherFunc collects a single snapshot of metrics.
+type GatherFunc func(ctx context.Context) (map[string]float64, error)
+
+// PrometheusConfig holds the Prometheus listener configuration.
+type PrometheusConfig struct {
+	ListenAddress string
+	Path          string
+
+	// Optional basic auth; both must be set to enable it.
+	Username string
+	Password string
+
+	// Optional TLS; both must be set to serve HTTPS.
+	CertFile string
+	KeyFile  string
+}
+
+// PrometheusServer serves collected metrics in the Prometheus text
+// exposition format. It runs independently of the control plane connection.
+type PrometheusServer struct {
+	config   PrometheusConfig
+	gather   GatherFunc
+	server   *http.Server
+	listener net.Listener
+	mu       sync.Mutex
+	logger   *slog.Logger
+}
+
+// NewPrometheusServer creates a new Prometheus exporter.
+func NewPrometheusServer(config PrometheusConfig, gather GatherFunc) *PrometheusServer {
+	if config.Path == "" {
+		config.Path = "/metrics"
+	}
+	return &PrometheusServer{
+		config: config,
+		gather: gather,
+		logger: slog.Default(),
+	}
+}
+
+// SetLogger sets the logger for the server.
+func (s *PrometheusServer) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// Start binds the listener and begins serving in the background.
+func (s *PrometheusServer) Start() error {
+	ln, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("listen %s: %w", s.config.ListenAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(s.config.Path, s.Handler())
+
+	s.mu.Lock()
+	s.listener = ln
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	server := s.server
+	s.mu.Unlock()
+
+	tlsEnabled := s.config.CertFile != "" && s.config.KeyFile != ""
+
+	go func() {
+		var err error
+		if tlsEnabled {
+			err = server.ServeTLS(ln, s.config.CertFile, s.config.KeyFile)
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("prometheus exporter stopped", "error", err)
+		}
+	}()
+
+	s.logger.Info("prometheus exporter listening",
+		"address", ln.Addr().String(),
+		"path", s.config.Path,
+		"tls", tlsEnabled,
+		"basic_auth", s.config.Username != "",
+	)
+
+	return nil
+}
+
+// Addr returns the address the server is listening on, or "" if not started.
+func (s *PrometheusServer) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Shutdown gracefully stops the server.
+func (s *PrometheusServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// Handler returns the HTTP handler serving the metrics page.
+func (s *PrometheusServer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="deploydb-agent"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		start := time.Now()
+		metrics, err := s.gather(r.Context())
+		duration := time.Since(start)
+
+		success := 1.0
+		if err != nil {
+			s.logger.Warn("prometheus scrape failed", "error", err)
+			success = 0
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WritePrometheus(w, metrics); err != nil {
+			return
+		}
+		WritePrometheus(w, map[string]float64{
+			"deploydb_agent_scrape_duration_seconds": duration.Seconds(),
+			"deploydb_agent_scrape_success":          success,
+		})
+	})
+}
+
+// authorized checks basic auth credentials if they are configured.
+func (s *PrometheusServer) authorized(r *http.Request) bool {
+	if s.config.Username == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.Password)) == 1
+	return userOK && passOK
+}
+
+// selfDescriptions documents the exporter's own metrics.
+var selfDescriptions = map[string]collector.MetricDesc{
+	"deploydb_agent_scrape_duration_seconds": {Help: "Time spent collecting metrics for this scrape.", Type: collector.Gauge},
+	"deploydb_agent_scrape_success":          {Help: "Whether the last collection succeeded (1) or failed (0).", Type: collector.Gauge},
+}
+
+// WritePrometheus writes metrics in the Prometheus text exposition format,
+// including HELP and TYPE lines once per metric. Metrics are written in
+// name order, labeled series of a metric together.
+func WritePrometheus(w io.Writer, metrics map[string]float64) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range groupSeries(metrics) {
+		desc, ok := selfDescriptions[f.name]
+		if !ok {
+			desc = collector.Describe(f.name)
+		}
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escapeHelp(desc.Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, desc.Type)
+		for _, series := range f.series {
+			fmt.Fprintf(bw, "%s %s\n", series, formatValue(metrics[series]))
+		}
+	}
+	return bw.Flush()
+}
+
+// escapeHelp escapes a HELP string as required by the text format.
+func escapeHelp(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+// formatValue formats a sample value, including the special float values.
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,231 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	err := WritePrometheus(&buf, map[string]float64{
+		"pg_deadlocks_total":    3,
+		"pg_connections_active": 5,
+		"custom_metric":         math.Inf(1),
+	})
+	if err != nil {
+		t.Fatalf("WritePrometheus() error = %v", err)
+	}
+
+	expected := `# HELP custom_metric custom_metric
+# TYPE custom_metric gauge
+custom_metric +Inf
+# HELP pg_connections_active Number of non-idle backend connections.
+# TYPE pg_connections_active gauge
+pg_connections_active 5
+# HELP pg_deadlocks_total Deadlocks detected across all databases.
+# TYPE pg_deadlocks_total counter
+pg_deadlocks_total 3
+`
+	if buf.String() != expected {
+		t.Errorf("WritePrometheus() =\n%s\nwant\n%s", buf.String(), expected)
+	}
+}
+
+func TestWritePrometheus_Labels(t *testing.T) {
+	var buf bytes.Buffer
+	err := WritePrometheus(&buf, map[string]float64{
+		`pg_connections_active{instance_id="pg15"}`: 2,
+		`pg_connections_active{instance_id="main"}`: 5,
+		"pg_connections_active_x":                   1,
+	})
+	if err != nil {
+		t.Fatalf("WritePrometheus() error = %v", err)
+	}
+
+	expected := `# HELP pg_connections_active Number of non-idle backend connections.
+# TYPE pg_connections_active gauge
+pg_connections_active{instance_id="main"} 5
+pg_connections_active{instance_id="pg15"} 2
+# HELP pg_connections_active_x pg_connections_active_x
+# TYPE pg_connections_active_x gauge
+pg_connections_active_x 1
+`
+	if buf.String() != expected {
+		t.Errorf("WritePrometheus() =\n%s\nwant\n%s", buf.String(), expected)
+	}
+}
+
+func TestPrometheusServer_Handler(t *testing.T) {
+	s := NewPrometheusServer(PrometheusConfig{}, func(ctx context.Context) (map[string]float64, error) {
+		return map[string]float64{"pg_connections_active": 7}, nil
+	})
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"pg_connections_active 7\n",
+		"# TYPE pg_connections_active gauge\n",
+		"deploydb_agent_scrape_success 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestPrometheusServer_GatherError(t *testing.T) {
+	s := NewPrometheusServer(PrometheusConfig{}, func(ctx context.Context) (map[string]float64, error) {
+		return nil, errors.New("postgres down")
+	})
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !strings.Contains(rec.Body.String(), "deploydb_agent_scrape_success 0\n") {
+		t.Errorf("expected scrape_success 0, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestPrometheusServer_BasicAuth(t *testing.T) {
+	s := NewPrometheusServer(PrometheusConfig{
+		Username: "prom",
+		Password: "secret",
+	}, func(ctx context.Context) (map[string]float64, error) {
+		return map[string]float64{}, nil
+	})
+
+	tests := []struct {
+		name       string
+		user, pass string
+		setAuth    bool
+		wantStatus int
+	}{
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "prom", "wrong", true, http.StatusUnauthorized},
+		{"valid credentials", "prom", "secret", true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.setAuth {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rec := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPrometheusServer_StartTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+
+	s := NewPrometheusServer(PrometheusConfig{
+		ListenAddress: "127.0.0.1:0",
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+	}, func(ctx context.Context) (map[string]float64, error) {
+		return map[string]float64{"system_cpu_count": 4}, nil
+	})
+
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get("https://" + s.Addr() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "system_cpu_count 4\n") {
+		t.Errorf("body missing system_cpu_count:\n%s", body)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and returns
+// the certificate and key file paths.
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deploydb-agent-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	return certFile, keyFile
+}
@@ -0,0 +1,36 @@
+package exporter
+
+import (
+	"sort"
+
+	"github.com/deploydb/agent/internal/collector"
+)
+
+// family is a metric and the keys of all its series.
+type family struct {
+	name   string
+	series []string
+}
+
+// groupSeries groups series keys by metric name. Families and the series
+// within each are sorted.
+func groupSeries(metrics map[string]float64) []family {
+	index := make(map[string]int)
+	var families []family
+	for series := range metrics {
+		name := collector.MetricName(series)
+		i, ok := index[name]
+		if !ok {
+			i = len(families)
+			index[name] = i
+			families = append(families, family{name: name})
+		}
+		families[i].series = append(families[i].series, series)
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, f := range families {
+		sort.Strings(f.series)
+	}
+	return families
+}
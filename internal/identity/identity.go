@@ -0,0 +1,156 @@
+// Package identity manages the agent's Ed25519 identity keypair.
+//
+// The keypair is generated on first run and stored as a PKCS#8 PEM file
+// readable only by the agent. The public key is registered with the control
+// plane during bootstrap; the private key signs agent_hello so the control
+// plane can tell agents apart even if a token leaks.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Algorithm is the signature algorithm name sent to the control plane.
+const Algorithm = "ed25519"
+
+const pemType = "PRIVATE KEY"
+
+// Identity is an agent keypair.
+type Identity struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// LoadOrCreate loads the keypair stored at path, generating and saving a
+// new one if the file does not exist.
+func LoadOrCreate(path string) (*Identity, error) {
+	id, err := Load(path)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	id, err = Generate()
+	if err != nil {
+		return nil, err
+	}
+	if err := id.Save(path); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Generate creates a new random keypair.
+func Generate() (*Identity, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	return &Identity{private: private, public: public}, nil
+}
+
+// Load reads a keypair from a PEM file.
+func Load(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read identity key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, fmt.Errorf("identity key %s: no %s PEM block", path, pemType)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse identity key: %w", err)
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key %s is %T, want ed25519", path, key)
+	}
+
+	return &Identity{private: private, public: private.Public().(ed25519.PublicKey)}, nil
+}
+
+// Save writes the private key to path with mode 0600. The parent directory
+// is created if needed and an existing file is never overwritten.
+func (id *Identity) Save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.private)
+	if err != nil {
+		return fmt.Errorf("marshal identity key: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("create identity dir: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("create identity key: %w", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: pemType, Bytes: der}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("write identity key: %w", err)
+	}
+	return f.Close()
+}
+
+// PublicKey returns the base64-encoded raw public key.
+func (id *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(id.public)
+}
+
+// KeyID returns a short, stable identifier for the public key.
+func (id *Identity) KeyID() string {
+	sum := sha256.Sum256(id.public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign signs message and returns the base64-encoded signature.
+func (id *Identity) Sign(message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(id.private, message))
+}
+
+// challengePrefix separates challenge signatures from every other message
+// the key signs.
+const challengePrefix = "deploydb-agent-challenge\n"
+
+// ChallengeMessage returns the bytes SignChallenge signs for nonce.
+func ChallengeMessage(nonce string) []byte {
+	return []byte(challengePrefix + nonce)
+}
+
+// SignChallenge answers a control plane nonce. The signature proves
+// possession of the private key without revealing any shared secret.
+func (id *Identity) SignChallenge(nonce string) string {
+	return id.Sign(ChallengeMessage(nonce))
+}
+
+// Verify checks a base64-encoded signature made by Sign against a
+// base64-encoded public key.
+func Verify(publicKey string, message []byte, signature string) bool {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, message, sig)
+}
@@ -0,0 +1,78 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "identity.key")
+
+	id, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreate() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("identity key not written: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("key file mode = %o, want 600", mode)
+	}
+
+	reloaded, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreate() second call error = %v", err)
+	}
+	if reloaded.PublicKey() != id.PublicKey() {
+		t.Error("reloading the identity produced a different key")
+	}
+	if reloaded.KeyID() != id.KeyID() {
+		t.Errorf("KeyID() = %v, want %v", reloaded.KeyID(), id.KeyID())
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	id, err := Generate()
+	if err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+
+	msg := []byte("agent_hello")
+	sig := id.Sign(msg)
+
+	if !Verify(id.PublicKey(), msg, sig) {
+		t.Error("Verify() rejected a valid signature")
+	}
+	if Verify(id.PublicKey(), []byte("tampered"), sig) {
+		t.Error("Verify() accepted a signature over a different message")
+	}
+
+	other, _ := Generate()
+	if Verify(other.PublicKey(), msg, sig) {
+		t.Error("Verify() accepted a signature from a different key")
+	}
+
+	// A challenge signature is only valid as one
+	challenge := id.SignChallenge("nonce")
+	if !Verify(id.PublicKey(), ChallengeMessage("nonce"), challenge) {
+		t.Error("Verify() rejected a valid challenge signature")
+	}
+	if Verify(id.PublicKey(), []byte("nonce"), challenge) {
+		t.Error("challenge signature is valid over the bare nonce")
+	}
+}
+
+func TestLoad_RejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	os.WriteFile(path, []byte("not a key"), 0600)
+
+	if _, err := Load(path); err == nil {
+		t.Error("Load() should fail on a file without a PEM block")
+	}
+	if _, err := LoadOrCreate(path); err == nil {
+		t.Error("LoadOrCreate() must not replace an unreadable key")
+	}
+}
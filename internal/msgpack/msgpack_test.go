@@ -0,0 +1,107 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal_Encodings(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want []byte
+	}{
+		{"nil", nil, []byte{0xc0}},
+		{"true", true, []byte{0xc3}},
+		{"positive fixint", 5, []byte{0x05}},
+		{"negative fixint", -3, []byte{0xfd}},
+		{"int16", 1000, []byte{0xd1, 0x03, 0xe8}},
+		{"whole float as int", 42.0, []byte{0x2a}},
+		{"float32", 1.5, []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}},
+		{"float64", 0.1, []byte{0xcb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{"fixstr", "ok", []byte{0xa2, 'o', 'k'}},
+		{"fixarray", []interface{}{1, "a"}, []byte{0x92, 0x01, 0xa1, 'a'}},
+		{"sorted map", map[string]interface{}{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.in)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := map[string]interface{}{
+		"type": "metrics",
+		"payload": map[string]interface{}{
+			"timestamp": int64(1700000000000),
+			"metrics": map[string]interface{}{
+				"pg_cache_hit_ratio": 0.987,
+				"pg_connections_max": int64(100),
+				"negative":           int64(-70000),
+				"big":                int64(math.MaxInt64),
+				"tiny":               1e-300,
+			},
+			"backfill": true,
+			"labels":   []interface{}{"a", nil, false},
+			"long":     strings.Repeat("x", 70000),
+		},
+	}
+
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	out, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n got %#v\nwant %#v", out, in)
+	}
+}
+
+func TestMarshal_JSONNumber(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{"n": 12, "f": 2.5}`))
+	dec.UseNumber()
+	var v interface{}
+	dec.Decode(&v)
+
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	out, _ := Unmarshal(data)
+	want := map[string]interface{}{"n": int64(12), "f": 2.5}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("Unmarshal() = %#v, want %#v", out, want)
+	}
+}
+
+func TestUnmarshal_Malformed(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated string": {0xa5, 'a'},
+		"truncated array":  {0x93, 0x01},
+		"huge map length":  {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"non-string key":   {0x81, 0x01, 0x01},
+		"trailing bytes":   {0x01, 0x02},
+		"unsupported ext":  {0xd4, 0x01, 0x01},
+	}
+
+	for name, data := range tests {
+		if _, err := Unmarshal(data); err == nil {
+			t.Errorf("%s: Unmarshal() should fail", name)
+		}
+	}
+}
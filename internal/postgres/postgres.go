@@ -0,0 +1,104 @@
+// Package postgres opens connections to the monitored PostgreSQL servers.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/deploydb/agent/internal/config"
+)
+
+// Open connects to PostgreSQL with the given settings and checks that the
+// server matches target_session_attrs.
+//
+// lib/pq only implements some of libpq's SSL modes, so "prefer" tries
+// "require" and falls back to "disable" when the server has no SSL, and
+// "allow" tries "disable" first and then "require".
+func Open(ctx context.Context, pg config.PostgresConfig) (*sql.DB, error) {
+	attempts := []string{pg.SSLMode}
+	switch pg.SSLMode {
+	case "prefer":
+		attempts = []string{"require", "disable"}
+	case "allow":
+		attempts = []string{"disable", "require"}
+	}
+
+	var db *sql.DB
+	var err error
+	for i, mode := range attempts {
+		attempt := pg
+		attempt.SSLMode = mode
+		db, err = connect(ctx, attempt.DSN())
+		if err == nil {
+			break
+		}
+		// prefer only falls back when SSL is unavailable, allow on any error
+		if i+1 < len(attempts) && pg.SSLMode == "prefer" && !errors.Is(err, pq.ErrSSLNotSupported) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckSessionAttrs(ctx, db, pg.TargetSessionAttrs); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// connect opens a pool and makes sure the server is reachable.
+func connect(ctx context.Context, dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// CheckSessionAttrs returns an error if the server does not satisfy
+// target_session_attrs. With a single host, prefer-standby accepts any
+// server.
+func CheckSessionAttrs(ctx context.Context, db *sql.DB, attrs string) error {
+	if attrs == "" || attrs == "any" || attrs == "prefer-standby" {
+		return nil
+	}
+
+	var inRecovery, readOnly bool
+	err := db.QueryRowContext(ctx,
+		"SELECT pg_is_in_recovery(), current_setting('transaction_read_only') = 'on'").Scan(&inRecovery, &readOnly)
+	if err != nil {
+		return fmt.Errorf("checking target_session_attrs: %w", err)
+	}
+
+	if !sessionMatches(attrs, inRecovery, readOnly) {
+		return fmt.Errorf("server does not match target_session_attrs=%s (in recovery: %t, read only: %t)",
+			attrs, inRecovery, readOnly)
+	}
+	return nil
+}
+
+// sessionMatches applies libpq's target_session_attrs rules.
+func sessionMatches(attrs string, inRecovery, readOnly bool) bool {
+	switch attrs {
+	case "read-write":
+		return !readOnly
+	case "read-only":
+		return readOnly
+	case "primary":
+		return !inRecovery
+	case "standby":
+		return inRecovery
+	default:
+		return true
+	}
+}
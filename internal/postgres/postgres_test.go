@@ -0,0 +1,111 @@
+package postgres
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+)
+
+func TestSessionMatches(t *testing.T) {
+	tests := []struct {
+		attrs      string
+		inRecovery bool
+		readOnly   bool
+		want       bool
+	}{
+		{"any", true, true, true},
+		{"read-write", false, false, true},
+		{"read-write", false, true, false},
+		{"read-only", true, true, true},
+		{"read-only", false, false, false},
+		{"primary", false, true, true},
+		{"primary", true, true, false},
+		{"standby", true, true, true},
+		{"standby", false, false, false},
+		{"prefer-standby", false, false, true},
+	}
+
+	for _, tt := range tests {
+		if got := sessionMatches(tt.attrs, tt.inRecovery, tt.readOnly); got != tt.want {
+			t.Errorf("sessionMatches(%s, recovery=%t, read only=%t) = %t, want %t",
+				tt.attrs, tt.inRecovery, tt.readOnly, got, tt.want)
+		}
+	}
+}
+
+// fakeServer refuses SSL and drops every other connection, recording
+// which kind of request each connection started with.
+func fakeServer(t *testing.T) (config.PostgresConfig, func() []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	var requests []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(conn, header); err == nil {
+				kind := "startup"
+				if binary.BigEndian.Uint32(header[4:]) == sslRequestCode {
+					kind = "ssl"
+					conn.Write([]byte{'N'})
+				}
+				mu.Lock()
+				requests = append(requests, kind)
+				mu.Unlock()
+			}
+			conn.Close()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	pg := config.PostgresConfig{Host: "127.0.0.1", Port: addr.Port, User: "agent", ConnectTimeout: 2 * time.Second}
+	return pg, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+// sslRequestCode starts an SSLRequest message.
+const sslRequestCode = 80877103
+
+func TestOpen_SSLModeFallback(t *testing.T) {
+	tests := []struct {
+		sslmode string
+		want    string
+	}{
+		{"prefer", "ssl startup"},
+		{"require", "ssl"},
+		{"disable", "startup"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sslmode, func(t *testing.T) {
+			pg, requests := fakeServer(t)
+			pg.SSLMode = tt.sslmode
+
+			if _, err := Open(context.Background(), pg); err == nil {
+				t.Fatal("Open() should fail against the fake server")
+			}
+			if got := strings.Join(requests(), " "); got != tt.want {
+				t.Errorf("requests = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+)
+
+// Pool limits. The agent runs a few short queries per collection, so a
+// small pool is enough and leaves connection slots to applications.
+const (
+	maxOpenConns    = 4
+	maxIdleConns    = 2
+	connMaxIdleTime = 5 * time.Minute
+	connMaxLifetime = time.Hour
+)
+
+// Supervisor keeps a connection pool to one PostgreSQL instance. While the
+// server is unreachable it retries in the background with backoff, and
+// while connected it pings the server, so collection stops cleanly when
+// the server goes away and resumes once it is back.
+type Supervisor struct {
+	mu       sync.RWMutex
+	pg       config.PostgresConfig
+	db       *sql.DB
+	version  string
+	errors   int  // failed connection attempts and health checks
+	failing  bool // an outage has already been logged
+	lastErr  error
+	onChange []func(db *sql.DB)
+
+	retryInitial  time.Duration
+	retryMax      time.Duration
+	checkInterval time.Duration
+
+	reconfigureCh chan struct{}
+	stopCh        chan struct{}
+	stoppedCh     chan struct{}
+	logger        *slog.Logger
+}
+
+// NewSupervisor creates a supervisor for the given connection settings.
+// It does not connect until Connect or Start is called.
+func NewSupervisor(pg config.PostgresConfig) *Supervisor {
+	return &Supervisor{
+		pg:            pg,
+		retryInitial:  time.Second,
+		retryMax:      time.Minute,
+		checkInterval: 10 * time.Second,
+		reconfigureCh: make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+		stoppedCh:     make(chan struct{}),
+		logger:        slog.Default(),
+	}
+}
+
+// SetLogger sets a custom logger.
+func (s *Supervisor) SetLogger(logger *slog.Logger) {
+	s.logger = logger
+}
+
+// OnChange adds a function called with the new pool after connecting, and
+// with nil after the connection is lost. Functions run in the order they
+// were added, and the old pool is closed after all of them return.
+func (s *Supervisor) OnChange(fn func(db *sql.DB)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// DB returns the connection pool, or nil while disconnected.
+func (s *Supervisor) DB() *sql.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db
+}
+
+// Version returns the server version string of the current connection.
+func (s *Supervisor) Version() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// Err returns why the last connection attempt or health check failed, or
+// nil while connected.
+func (s *Supervisor) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastErr
+}
+
+// Metrics returns pg_up and the number of failed connection attempts and
+// health checks.
+func (s *Supervisor) Metrics() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	up := 0.0
+	if s.db != nil {
+		up = 1
+	}
+	return map[string]float64{
+		"pg_up":                      up,
+		"pg_connection_errors_total": float64(s.errors),
+	}
+}
+
+// Connect makes one connection attempt unless already connected. Calling
+// it before Start lets the first collection see the server.
+func (s *Supervisor) Connect(ctx context.Context) error {
+	s.mu.RLock()
+	pg, connected := s.pg, s.db != nil
+	s.mu.RUnlock()
+	if connected {
+		return nil
+	}
+
+	db, err := Open(ctx, pg)
+	if err != nil {
+		s.mu.Lock()
+		s.errors++
+		s.lastErr = err
+		logged := s.failing
+		s.failing = true
+		s.mu.Unlock()
+		// Log the first failure of an outage, then only at debug level
+		if !logged {
+			s.logger.Warn("PostgreSQL not available, retrying in the background", "error", err)
+		} else {
+			s.logger.Debug("PostgreSQL connection attempt failed", "error", err)
+		}
+		return err
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT version()").Scan(&version); err != nil {
+		s.logger.Debug("failed to query PostgreSQL version", "error", err)
+	}
+
+	s.logger.Info("connected to PostgreSQL", "host", pg.Host, "version", version)
+	s.mu.Lock()
+	s.failing, s.lastErr = false, nil
+	s.mu.Unlock()
+	s.swap(db, version)
+	return nil
+}
+
+// Start runs the supervisor in the background until ctx is cancelled or
+// Stop is called.
+func (s *Supervisor) Start(ctx context.Context) {
+	go s.run(ctx)
+}
+
+// Stop stops the supervisor and closes the connection pool.
+func (s *Supervisor) Stop() {
+	close(s.stopCh)
+	<-s.stoppedCh
+}
+
+// Reconfigure replaces the connection settings and reconnects.
+func (s *Supervisor) Reconfigure(pg config.PostgresConfig) {
+	s.mu.Lock()
+	s.pg = pg
+	s.mu.Unlock()
+
+	select {
+	case s.reconfigureCh <- struct{}{}:
+	default:
+	}
+}
+
+// run reconnects with exponential backoff while disconnected and checks
+// the connection at checkInterval while connected.
+func (s *Supervisor) run(ctx context.Context) {
+	defer close(s.stoppedCh)
+	defer s.swap(nil, "")
+
+	delay := s.retryInitial
+	for {
+		wait := s.checkInterval
+		if s.DB() == nil {
+			if err := s.Connect(ctx); err != nil {
+				wait = delay
+				delay = min(delay*2, s.retryMax)
+			} else {
+				delay = s.retryInitial
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case <-s.reconfigureCh:
+			timer.Stop()
+			s.logger.Info("PostgreSQL settings changed, reconnecting")
+			s.swap(nil, "")
+			delay = s.retryInitial
+		case <-timer.C:
+			s.check(ctx)
+		}
+	}
+}
+
+// check pings the server and drops the pool if it does not answer.
+func (s *Supervisor) check(ctx context.Context) {
+	db := s.DB()
+	if db == nil {
+		return
+	}
+
+	s.mu.RLock()
+	timeout := s.pg.ConnectTimeout
+	s.mu.RUnlock()
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("lost connection to PostgreSQL, reconnecting", "error", err)
+		s.mu.Lock()
+		s.errors++
+		s.failing, s.lastErr = true, err
+		s.mu.Unlock()
+		s.swap(nil, "")
+	}
+}
+
+// swap replaces the pool, notifies OnChange and closes the old pool.
+func (s *Supervisor) swap(db *sql.DB, version string) {
+	s.mu.Lock()
+	old, onChange := s.db, s.onChange
+	s.db, s.version = db, version
+	s.mu.Unlock()
+
+	if old == nil && db == nil {
+		return
+	}
+	for _, fn := range onChange {
+		fn(db)
+	}
+	if old != nil {
+		old.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deploydb/agent/internal/config"
+)
+
+func TestSupervisor_ConnectFailure(t *testing.T) {
+	pg, _ := fakeServer(t)
+	pg.SSLMode = "disable"
+
+	s := NewSupervisor(pg)
+	if err := s.Connect(context.Background()); err == nil {
+		t.Fatal("Connect() should fail against the fake server")
+	}
+	if s.DB() != nil {
+		t.Error("DB() should be nil while disconnected")
+	}
+	if s.Err() == nil {
+		t.Error("Err() should report the failed attempt")
+	}
+
+	metrics := s.Metrics()
+	if metrics["pg_up"] != 0 {
+		t.Errorf("pg_up = %v, want 0", metrics["pg_up"])
+	}
+	if metrics["pg_connection_errors_total"] != 1 {
+		t.Errorf("pg_connection_errors_total = %v, want 1", metrics["pg_connection_errors_total"])
+	}
+}
+
+func TestSupervisor_RetriesInBackground(t *testing.T) {
+	pg, requests := fakeServer(t)
+	pg.SSLMode = "disable"
+
+	s := NewSupervisor(pg)
+	s.retryInitial = 10 * time.Millisecond
+	s.retryMax = 20 * time.Millisecond
+	s.Start(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(requests()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+
+	if got := len(requests()); got < 3 {
+		t.Fatalf("connection attempts = %d, want at least 3", got)
+	}
+	if got := s.Metrics()["pg_connection_errors_total"]; got < 3 {
+		t.Errorf("pg_connection_errors_total = %v, want at least 3", got)
+	}
+}
+
+func TestSupervisor_Reconfigure(t *testing.T) {
+	pg, _ := fakeServer(t)
+	pg.SSLMode = "disable"
+	next, nextRequests := fakeServer(t)
+	next.SSLMode = "disable"
+
+	s := NewSupervisor(pg)
+	// Back off long enough that only Reconfigure triggers another attempt
+	s.retryInitial = time.Hour
+	s.Start(context.Background())
+	defer s.Stop()
+
+	s.Reconfigure(next)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(nextRequests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(nextRequests()) == 0 {
+		t.Error("Reconfigure() should reconnect with the new settings")
+	}
+}
+
+func TestSupervisor_OnChangeNotifiesEveryListener(t *testing.T) {
+	db, err := sql.Open("postgres", "host=localhost sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSupervisor(config.PostgresConfig{})
+	var calls []string
+	s.OnChange(func(db *sql.DB) { calls = append(calls, fmt.Sprintf("first %v", db != nil)) })
+	s.OnChange(func(db *sql.DB) { calls = append(calls, fmt.Sprintf("second %v", db != nil)) })
+
+	s.swap(db, "16.2")
+	s.swap(nil, "")
+
+	want := "first true, second true, first false, second false"
+	if got := strings.Join(calls, ", "); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+// Package proxy selects the outbound proxy for connections to the control
+// plane and other HTTP endpoints.
+//
+// The same selection is used for the WebSocket dialer, the bootstrap HTTP
+// client and HTTP metric sinks, so a host that needs a proxy for one needs
+// no extra configuration for the others.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Config describes an explicit proxy.
+type Config struct {
+	// URL is the proxy address: http://[user:pass@]host:port for HTTP
+	// CONNECT, or socks5://[user:pass@]host:port. Empty falls back to the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+	URL string
+
+	// NoProxy is a comma-separated list of hosts that are reached directly:
+	// host names (matching subdomains too), ".domain" suffixes, IP
+	// addresses, CIDR ranges, optional ":port" suffixes, or "*".
+	NoProxy string
+}
+
+// Validate checks that the proxy URL is usable.
+func (c Config) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	_, err := parseURL(c.URL)
+	return err
+}
+
+// Func returns a proxy function for http.Transport.Proxy and
+// websocket.Dialer.Proxy.
+func (c Config) Func() (func(*http.Request) (*url.URL, error), error) {
+	if c.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := parseURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	rules := parseNoProxy(c.NoProxy)
+
+	return func(req *http.Request) (*url.URL, error) {
+		if rules.match(req.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// Transport returns an http.Transport that uses the proxy.
+func (c Config) Transport() (*http.Transport, error) {
+	proxyFunc, err := c.Func()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxyFunc
+	return t, nil
+}
+
+// Redacted returns the proxy URL with any password masked, for logging.
+func (c Config) Redacted() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+func parseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy url %q has no host", u.Redacted())
+	}
+	return u, nil
+}
+
+var defaultPorts = map[string]string{"http": "80", "ws": "80", "https": "443", "wss": "443"}
+
+// noProxy holds parsed NO_PROXY rules.
+type noProxy struct {
+	all     bool
+	domains []hostRule
+	ips     []net.IP
+	nets    []*net.IPNet
+}
+
+type hostRule struct {
+	host string // lower case, without leading "."
+	port string // empty matches any port
+	// exact is set for ".domain" rules in the form "domain" (no dot), which
+	// also match the domain itself.
+	exact bool
+}
+
+func parseNoProxy(list string) noProxy {
+	var rules noProxy
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			rules.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			rules.nets = append(rules.nets, ipNet)
+			continue
+		}
+
+		host, port := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host, port = h, p
+		}
+		if ip := net.ParseIP(host); ip != nil && port == "" {
+			rules.ips = append(rules.ips, ip)
+			continue
+		}
+
+		rule := hostRule{host: strings.TrimPrefix(host, "."), port: port, exact: !strings.HasPrefix(host, ".")}
+		if strings.HasPrefix(rule.host, "*.") {
+			rule.host, rule.exact = rule.host[2:], false
+		}
+		rules.domains = append(rules.domains, rule)
+	}
+	return rules
+}
+
+// match reports whether u should bypass the proxy.
+func (n noProxy) match(u *url.URL) bool {
+	if n.all {
+		return true
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, candidate := range n.ips {
+			if candidate.Equal(ip) {
+				return true
+			}
+		}
+		for _, ipNet := range n.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, rule := range n.domains {
+		if rule.port != "" && rule.port != port {
+			continue
+		}
+		if host == rule.host && rule.exact {
+			return true
+		}
+		if strings.HasSuffix(host, "."+rule.host) {
+			return true
+		}
+	}
+	return false
+}
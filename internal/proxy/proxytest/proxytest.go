@@ -0,0 +1,231 @@
+// Package proxytest provides local HTTP CONNECT and SOCKS5 proxies for
+// tests.
+package proxytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is a running proxy.
+type Server struct {
+	// URL is the proxy URL, including credentials if required.
+	URL string
+
+	listener net.Listener
+	username string
+	password string
+	tunnels  atomic.Int64
+	wg       sync.WaitGroup
+}
+
+// NewConnectProxy starts an HTTP CONNECT proxy. If username is not empty
+// the proxy requires basic auth.
+func NewConnectProxy(username, password string) (*Server, error) {
+	s, err := newServer("http", username, password)
+	if err != nil {
+		return nil, err
+	}
+	s.serve(s.handleConnect)
+	return s, nil
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy. If username is not empty the
+// proxy requires username/password auth.
+func NewSOCKS5Proxy(username, password string) (*Server, error) {
+	s, err := newServer("socks5", username, password)
+	if err != nil {
+		return nil, err
+	}
+	s.serve(s.handleSOCKS5)
+	return s, nil
+}
+
+func newServer(scheme, username, password string) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: l, username: username, password: password}
+	if username != "" {
+		s.URL = fmt.Sprintf("%s://%s:%s@%s", scheme, username, password, l.Addr())
+	} else {
+		s.URL = fmt.Sprintf("%s://%s", scheme, l.Addr())
+	}
+	return s, nil
+}
+
+// Tunnels returns the number of tunnels the proxy has opened.
+func (s *Server) Tunnels() int {
+	return int(s.tunnels.Load())
+}
+
+// Close stops the proxy.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve(handle func(net.Conn)) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+}
+
+func (s *Server) handleConnect(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if s.username != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.username+":"+s.password))
+		if req.Header.Get("Proxy-Authorization") != want {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+			conn.Close()
+			return
+		}
+	}
+
+	s.tunnel(conn, br, req.Host, func(ok bool) {
+		if ok {
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		} else {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		}
+	})
+}
+
+func (s *Server) handleSOCKS5(conn net.Conn) {
+	br := bufio.NewReader(conn)
+
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 5 {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		conn.Close()
+		return
+	}
+
+	want := byte(0x00)
+	if s.username != "" {
+		want = 0x02
+	}
+	offered := false
+	for _, m := range methods {
+		if m == want {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, want})
+
+	if s.username != "" {
+		// RFC 1929: VER ULEN UNAME PLEN PASSWD
+		ver, _ := br.ReadByte()
+		ulen, _ := br.ReadByte()
+		user := make([]byte, ulen)
+		io.ReadFull(br, user)
+		plen, _ := br.ReadByte()
+		pass := make([]byte, plen)
+		io.ReadFull(br, pass)
+		if ver != 1 || string(user) != s.username || string(pass) != s.password {
+			conn.Write([]byte{1, 1})
+			conn.Close()
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil || req[1] != 1 {
+		conn.Close()
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := br.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(br, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	default:
+		conn.Close()
+		return
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(br, portBytes); err != nil {
+		conn.Close()
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+
+	s.tunnel(conn, br, addr, func(ok bool) {
+		status := byte(0)
+		if !ok {
+			status = 5 // connection refused
+		}
+		conn.Write([]byte{5, status, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+}
+
+// tunnel dials addr, reports the result with reply and copies data in both
+// directions until either side closes.
+func (s *Server) tunnel(conn net.Conn, br *bufio.Reader, addr string, reply func(ok bool)) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		reply(false)
+		conn.Close()
+		return
+	}
+	s.tunnels.Add(1)
+	reply(true)
+
+	go func() {
+		io.Copy(target, br)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+	conn.Close()
+}
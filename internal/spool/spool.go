@@ -0,0 +1,194 @@
+// Package spool implements a size-capped, on-disk FIFO queue.
+//
+// Each entry is stored as its own file so that a crash can lose at most the
+// entry being written. When the queue grows beyond its size cap the oldest
+// entries are discarded.
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const entrySuffix = ".json"
+
+// Entry is a single queued item.
+type Entry struct {
+	Name string
+	Data []byte
+}
+
+// Spool is an on-disk FIFO queue. It is safe for concurrent use.
+type Spool struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries []entryInfo
+	size    int64
+	seq     uint64
+	dropped uint64
+}
+
+type entryInfo struct {
+	name string
+	size int64
+}
+
+// Open opens (or creates) a spool in dir. Entries left over from a previous
+// run are kept and replayed first. A maxBytes of 0 disables the size cap.
+func Open(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool dir: %w", err)
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := f.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Incomplete write from a previous run
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, entrySuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		s.entries = append(s.entries, entryInfo{name: name, size: info.Size()})
+		s.size += info.Size()
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].name < s.entries[j].name
+	})
+
+	s.mu.Lock()
+	s.enforceCap()
+	s.mu.Unlock()
+
+	return s, nil
+}
+
+// Push appends data to the end of the queue.
+func (s *Spool) Push(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, entrySuffix)
+	path := filepath.Join(s.dir, name)
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write spool entry: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("commit spool entry: %w", err)
+	}
+
+	s.entries = append(s.entries, entryInfo{name: name, size: int64(len(data))})
+	s.size += int64(len(data))
+	s.enforceCap()
+
+	return nil
+}
+
+// Oldest returns the entry at the head of the queue without removing it.
+// ok is false if the queue is empty.
+func (s *Spool) Oldest() (entry Entry, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.entries) > 0 {
+		head := s.entries[0]
+		data, err := os.ReadFile(filepath.Join(s.dir, head.name))
+		if err == nil {
+			return Entry{Name: head.name, Data: data}, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return Entry{}, false, fmt.Errorf("read spool entry: %w", err)
+		}
+		// Removed behind our back; skip it.
+		s.removeAt(0)
+	}
+
+	return Entry{}, false, nil
+}
+
+// Remove deletes an entry from the queue. Removing an entry that is no
+// longer queued is not an error.
+func (s *Spool) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.entries {
+		if e.name == name {
+			s.removeAt(i)
+			break
+		}
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove spool entry: %w", err)
+	}
+	return nil
+}
+
+// Len returns the number of queued entries.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Size returns the total size of queued entries in bytes.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of entries discarded to respect the size cap.
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// enforceCap discards the oldest entries until the queue fits its cap.
+// The newest entry is always kept. Must be called with s.mu held.
+func (s *Spool) enforceCap() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	for s.size > s.maxBytes && len(s.entries) > 1 {
+		os.Remove(filepath.Join(s.dir, s.entries[0].name))
+		s.removeAt(0)
+		s.dropped++
+	}
+}
+
+// removeAt removes the entry at index i from the index. Must be called with
+// s.mu held.
+func (s *Spool) removeAt(i int) {
+	s.size -= s.entries[i].size
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+}
@@ -0,0 +1,103 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpool_FIFO(t *testing.T) {
+	s, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Push([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+
+	if s.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", s.Len())
+	}
+
+	for i := 0; i < 3; i++ {
+		entry, ok, err := s.Oldest()
+		if err != nil || !ok {
+			t.Fatalf("Oldest() = %v, %v", ok, err)
+		}
+		if want := fmt.Sprintf("entry-%d", i); string(entry.Data) != want {
+			t.Errorf("Oldest() = %q, want %q", entry.Data, want)
+		}
+		if err := s.Remove(entry.Name); err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+	}
+
+	if _, ok, _ := s.Oldest(); ok {
+		t.Error("Oldest() on empty spool should return ok=false")
+	}
+	if s.Size() != 0 {
+		t.Errorf("Size() = %d, want 0", s.Size())
+	}
+}
+
+func TestSpool_SizeCapDropsOldest(t *testing.T) {
+	s, err := Open(t.TempDir(), 25)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	// Each entry is 10 bytes; only two fit under the cap.
+	for i := 0; i < 4; i++ {
+		if err := s.Push([]byte(fmt.Sprintf("entry-%04d", i))); err != nil {
+			t.Fatalf("Push() error = %v", err)
+		}
+	}
+
+	if s.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", s.Len())
+	}
+	if s.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", s.Dropped())
+	}
+
+	entry, _, _ := s.Oldest()
+	if string(entry.Data) != "entry-0002" {
+		t.Errorf("Oldest() = %q, want %q", entry.Data, "entry-0002")
+	}
+}
+
+func TestSpool_ReopenKeepsEntries(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	s.Push([]byte("first"))
+	s.Push([]byte("second"))
+
+	// Leftover from an interrupted write must be ignored
+	os.WriteFile(filepath.Join(dir, "garbage.json.tmp"), []byte("x"), 0600)
+
+	reopened, err := Open(dir, 0)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if reopened.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", reopened.Len())
+	}
+
+	entry, _, _ := reopened.Oldest()
+	if string(entry.Data) != "first" {
+		t.Errorf("Oldest() = %q, want %q", entry.Data, "first")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "garbage.json.tmp")); !os.IsNotExist(err) {
+		t.Error("leftover .tmp file was not cleaned up")
+	}
+}
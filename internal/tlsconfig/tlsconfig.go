@@ -0,0 +1,135 @@
+// Package tlsconfig builds client TLS configurations for connections to the
+// control plane.
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the control plane's certificate chain
+// does not contain any pinned public key.
+var ErrPinMismatch = errors.New("certificate does not match any pinned public key")
+
+// pinPrefix marks a base64 SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo, as used by HPKP and `openssl ... | base64`.
+const pinPrefix = "sha256/"
+
+// Options describes how the agent authenticates the control plane and,
+// optionally, itself.
+type Options struct {
+	// CAFile is a PEM bundle of CAs trusted instead of the system roots,
+	// for private control planes.
+	CAFile string
+
+	// CertFile and KeyFile hold the client certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// Pins are SPKI hashes ("sha256/<base64>"). When set, at least one
+	// certificate in the verified chain must match one of them. Pin a CA
+	// key to allow leaf renewals; list two pins to rotate without downtime.
+	Pins []string
+}
+
+// IsZero reports whether no TLS options are set.
+func (o Options) IsZero() bool {
+	return o.CAFile == "" && o.CertFile == "" && o.KeyFile == "" && len(o.Pins) == 0
+}
+
+// Build returns a client TLS config for opts. It returns nil, nil when no
+// options are set so callers keep the library defaults.
+func Build(opts Options) (*tls.Config, error) {
+	if opts.IsZero() {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no certificates", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate requires both cert_file and key_file")
+	}
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := make(map[string]bool, len(opts.Pins))
+		for _, pin := range opts.Pins {
+			if err := ValidatePin(pin); err != nil {
+				return nil, err
+			}
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// ValidatePin checks that pin is a well-formed SPKI hash.
+func ValidatePin(pin string) error {
+	hash, ok := strings.CutPrefix(pin, pinPrefix)
+	if !ok {
+		return fmt.Errorf("pin %q must start with %q", pin, pinPrefix)
+	}
+	raw, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+	}
+	return nil
+}
+
+// SPKIPin returns the pin for a certificate's public key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins runs after normal chain verification, so every certificate in
+// VerifiedChains is already trusted.
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 && len(cs.PeerCertificates) > 0 {
+		// Verification was skipped; only the presented leaf can be checked.
+		chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pins[SPKIPin(cert)] {
+				return nil
+			}
+		}
+	}
+
+	var leaf string
+	if len(cs.PeerCertificates) > 0 {
+		leaf = SPKIPin(cs.PeerCertificates[0])
+	}
+	return fmt.Errorf("%w: %s presented %s", ErrPinMismatch, cs.ServerName, leaf)
+}
@@ -0,0 +1,90 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	valid := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"missing prefix", base64.StdEncoding.EncodeToString(sum[:]), true},
+		{"wrong algorithm", "sha1/" + base64.StdEncoding.EncodeToString(sum[:20]), true},
+		{"not base64", "sha256/not-base64!", true},
+		{"wrong length", "sha256/" + base64.StdEncoding.EncodeToString(sum[:16]), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePin(tt.pin); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuild_Pins(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	serverPin := SPKIPin(server.Certificate())
+	sum := sha256.Sum256([]byte("some other key"))
+	otherPin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		pins     []string
+		mismatch bool
+	}{
+		{"matching pin", []string{serverPin}, false},
+		{"rotation with old and new pin", []string{otherPin, serverPin}, false},
+		{"mismatch", []string{otherPin}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Build(Options{CAFile: caFile, Pins: tt.pins})
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := client.Get(server.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			if tt.mismatch {
+				if !errors.Is(err, ErrPinMismatch) {
+					t.Errorf("Get() error = %v, want ErrPinMismatch", err)
+				}
+			} else if err != nil {
+				t.Errorf("Get() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestBuild_NoOptions(t *testing.T) {
+	cfg, err := Build(Options{})
+	if err != nil || cfg != nil {
+		t.Errorf("Build() = %v, %v; want nil, nil", cfg, err)
+	}
+}